@@ -1,10 +1,275 @@
 package config
 
-import "os"
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+)
 
-func GetEnvWithDefault(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+// Config holds the settings for all of the binaries.  Each setting starts with the default
+// below, and may then be set by the config file, an environment variable and a command-line
+// flag, in increasing order of precedence
+type Config struct {
+	DataDir         string       `json:"data_dir" env:"EDDP_API_DATA_DIR" flag:"data-dir" help:"Directory for downloaded data and SQL database"`
+	LogLevel        string       `json:"log_level" env:"EDDP_API_LOG_LEVEL" flag:"log-level" help:"Least severe level logged: debug, info, warn or error"`
+	ShutdownTimeout int          `json:"shutdown_timeout" env:"EDDP_API_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" help:"Seconds to wait for in-flight work when stopping"`
+	HTTP            HTTPConfig   `json:"http"`
+	EDDN            EDDNConfig   `json:"eddn"`
+	Import          ImportConfig `json:"import"`
+}
+
+type HTTPConfig struct {
+	Addr string `json:"addr" env:"EDDP_API_HTTP_ADDR" flag:"http-addr" help:"TCP address for the HTTP server"`
+	Root string `json:"root" env:"EDDP_API_HTTP_ROOT" flag:"http-root" help:"Static file root directory for the HTTP server"`
+}
+
+type EDDNConfig struct {
+	ListenerURL     string `json:"listener_url" env:"EDDP_API_EDDN_LISTENER_URL" flag:"eddn-listener-url" help:"URL for the EDDN listener"`
+	PublisherURL    string `json:"publisher_url" env:"EDDP_API_EDDN_PUBLISHER_URL" flag:"eddn-publisher-url" help:"URL for the EDDN publisher"`
+	Workers         int    `json:"workers" env:"EDDP_API_EDDN_WORKERS" flag:"eddn-workers" help:"Number of workers handling EDDN messages"`
+	QueueSize       int    `json:"queue_size" env:"EDDP_API_EDDN_QUEUE_SIZE" flag:"eddn-queue-size" help:"Number of EDDN messages queued for the workers"`
+	ArchiveDir      string `json:"archive_dir" env:"EDDP_API_EDDN_ARCHIVE_DIR" flag:"eddn-archive-dir" help:"Directory in which to archive EDDN messages, if any"`
+	Blocklist       string `json:"blocklist" env:"EDDP_API_EDDN_BLOCKLIST" flag:"eddn-blocklist" help:"File of rules for EDDN clients whose messages are ignored"`
+	AdminAddr       string `json:"admin_addr" env:"EDDP_API_EDDN_ADMIN_ADDR" flag:"eddn-admin-addr" help:"TCP address for the EDDN listener's admin HTTP server"`
+	AdminTokenFile  string `json:"admin_token_file" env:"EDDP_API_EDDN_ADMIN_TOKEN_FILE" flag:"eddn-admin-token-file" help:"File holding the token needed to swap databases through the admin server"`
+	MaxClockSkew    int    `json:"max_clock_skew" env:"EDDP_API_EDDN_MAX_CLOCK_SKEW" flag:"eddn-max-clock-skew" help:"Seconds a message's timestamp may be ahead of the gateway's"`
+	MaxMessageAge   int    `json:"max_message_age" env:"EDDP_API_EDDN_MAX_MESSAGE_AGE" flag:"eddn-max-message-age" help:"Seconds a message's timestamp may be behind the gateway's"`
+	DedupWindow     int    `json:"dedup_window" env:"EDDP_API_EDDN_DEDUP_WINDOW" flag:"eddn-dedup-window" help:"Seconds for which handled EDDN messages are remembered"`
+	LivenessTimeout int    `json:"liveness_timeout" env:"EDDP_API_EDDN_LIVENESS_TIMEOUT" flag:"eddn-liveness-timeout" help:"Seconds without an EDDN message after which we reconnect"`
+}
+
+type ImportConfig struct {
+	Source string `json:"source" env:"EDDP_API_IMPORT_SOURCE" flag:"import-source" help:"Source of systems, bodies and stations: spansh, edsm or eddb"`
+	URL    string `json:"url" env:"EDDP_API_IMPORT_URL" flag:"import-url" help:"URL to download the source's files from, or a local directory holding them"`
+	Dir    string `json:"dir" env:"EDDP_API_IMPORT_DIR" flag:"import-dir" help:"Directory for the downloaded files (default the source's name under data_dir)"`
+}
+
+func Defaults() Config {
+	return Config{
+		DataDir:         "./data",
+		LogLevel:        "info",
+		ShutdownTimeout: 30,
+		HTTP: HTTPConfig{
+			Addr: ":8080",
+			Root: "./data/http",
+		},
+		EDDN: EDDNConfig{
+			ListenerURL:     "tcp://eddn.edcd.io:9500",
+			PublisherURL:    "tcp://*:5556",
+			Workers:         runtime.NumCPU(),
+			QueueSize:       100,
+			Blocklist:       "./blocklist.json",
+			AdminAddr:       "localhost:8081",
+			MaxClockSkew:    600,
+			MaxMessageAge:   86400,
+			DedupWindow:     600,
+			LivenessTimeout: 60,
+		},
+		Import: ImportConfig{
+			Source: "spansh",
+		},
+	}
+}
+
+// The config file used if none is given
+const defaultFile = "./eddp.json"
+
+// Load builds the configuration, parsing the command line as it does so; any flags of the
+// binary's own must be defined first.  The config file is given by -config or EDDP_API_CONFIG,
+// and is optional unless given.  With -print-config the effective configuration is printed
+// and the binary exits
+func Load() (*Config, error) {
+	configFile := flag.String("config", "", "JSON config file (default "+defaultFile+" if it exists)")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration and exit")
+
+	cfg := Defaults()
+	var settings []setting
+	collectSettings(reflect.ValueOf(&cfg).Elem(), &settings)
+	for i := range settings {
+		if settings[i].flag != "" {
+			flag.Var(&settings[i], settings[i].flag, settings[i].help)
+		}
+	}
+	flag.Parse()
+
+	filename := *configFile
+	if filename == "" {
+		filename = os.Getenv("EDDP_API_CONFIG")
+	}
+	if filename != "" {
+		err := loadFile(filename, &cfg)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(defaultFile); err == nil {
+		err = loadFile(defaultFile, &cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			err := s.apply(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value for %s: %v", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if s.flagValue != nil {
+			err := s.apply(*s.flagValue)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value for -%s: %v", s.flag, err)
+			}
+		}
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if *printConfig {
+		data, _ := json.MarshalIndent(cfg, "", "\t")
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+	return &cfg, nil
+}
+
+func loadFile(filename string, cfg *Config) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+// Validate checks that the settings make sense
+func (c *Config) Validate() error {
+	if c.DataDir == "" {
+		return errors.New("data_dir must be set")
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		return errors.New("log_level must be debug, info, warn or error")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown_timeout must be positive")
+	}
+	if c.HTTP.Addr == "" {
+		return errors.New("http.addr must be set")
+	}
+	if c.EDDN.ListenerURL == "" || c.EDDN.PublisherURL == "" {
+		return errors.New("eddn.listener_url and eddn.publisher_url must be set")
+	}
+	if c.EDDN.Workers <= 0 {
+		return errors.New("eddn.workers must be positive")
+	}
+	if c.EDDN.QueueSize <= 0 {
+		return errors.New("eddn.queue_size must be positive")
+	}
+	if c.EDDN.MaxClockSkew < 0 || c.EDDN.MaxMessageAge <= 0 {
+		return errors.New("eddn.max_clock_skew must not be negative and eddn.max_message_age must be positive")
+	}
+	if c.EDDN.DedupWindow < 0 {
+		return errors.New("eddn.dedup_window must not be negative")
+	}
+	if c.EDDN.LivenessTimeout <= 0 {
+		return errors.New("eddn.liveness_timeout must be positive")
+	}
+	switch c.Import.Source {
+	case "spansh", "edsm", "eddb":
+	default:
+		return errors.New("import.source must be spansh, edsm or eddb")
+	}
+	return nil
+}
+
+// setting is a single configuration value that can be set from the environment or a flag
+type setting struct {
+	field     reflect.Value
+	env       string
+	flag      string
+	help      string
+	flagValue *string
+}
+
+func collectSettings(v reflect.Value, settings *[]setting) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			collectSettings(v.Field(i), settings)
+			continue
+		}
+		*settings = append(*settings, setting{
+			field: v.Field(i),
+			env:   field.Tag.Get("env"),
+			flag:  field.Tag.Get("flag"),
+			help:  field.Tag.Get("help"),
+		})
+	}
+}
+
+func (s *setting) apply(value string) error {
+	switch s.field.Kind() {
+	case reflect.String:
+		s.field.SetString(value)
+	case reflect.Int:
+		intValue, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		s.field.SetInt(int64(intValue))
+	default:
+		return errors.New("Unsupported setting type " + s.field.Kind().String())
+	}
+	return nil
+}
+
+// String and Set make a setting a flag.Value.  Flags are only noted when parsed, and applied
+// after the config file and environment so that they take precedence
+func (s *setting) String() string {
+	if !s.field.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(s.field.Interface())
+}
+
+func (s *setting) Set(value string) error {
+	s.flagValue = &value
+	return nil
+}
+
+// AdminToken reads the token that eddp-admin must give to have eddnlistener swap databases.  It
+// is kept in a file so that it does not appear in the logged configuration.  Without a file
+// there is no token, and swapping is disabled
+func (c *EDDNConfig) AdminToken() (string, error) {
+	if c.AdminTokenFile == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(c.AdminTokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New(c.AdminTokenFile + " is empty")
 	}
-	return fallback
+	return token, nil
 }
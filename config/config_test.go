@@ -0,0 +1,151 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// load runs Load as a binary started with the given arguments and environment would.  Load
+// defines its flags on the global flag set and parses os.Args, so both are replaced for the
+// duration, as is every EDDP_API_ variable
+func load(t *testing.T, args []string, env map[string]string) (*Config, error) {
+	t.Helper()
+	oldArgs := os.Args
+	oldCommandLine := flag.CommandLine
+	defer func() {
+		os.Args = oldArgs
+		flag.CommandLine = oldCommandLine
+	}()
+	os.Args = append([]string{"eddp-test"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if strings.HasPrefix(name, "EDDP_API_") {
+			value := os.Getenv(name)
+			os.Unsetenv(name)
+			defer os.Setenv(name, value)
+		}
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	return Load()
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eddp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "eddp.json")
+	err = ioutil.WriteFile(configFile, []byte(`{"data_dir": "/file", "log_level": "warn", "http": {"addr": ":9000", "root": "/file/http"}, "eddn": {"workers": 3, "queue_size": 30}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := load(t,
+		[]string{"-config", configFile, "-http-addr", ":9002", "-eddn-workers", "5"},
+		map[string]string{"EDDP_API_HTTP_ADDR": ":9001", "EDDP_API_HTTP_ROOT": "/env/http", "EDDP_API_EDDN_WORKERS": "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := Defaults()
+	tests := []struct {
+		name     string
+		actual   interface{}
+		expected interface{}
+	}{
+		// Set nowhere
+		{"shutdown_timeout", cfg.ShutdownTimeout, defaults.ShutdownTimeout},
+		{"eddn.listener_url", cfg.EDDN.ListenerURL, defaults.EDDN.ListenerURL},
+		// Set in the file
+		{"data_dir", cfg.DataDir, "/file"},
+		{"log_level", cfg.LogLevel, "warn"},
+		{"eddn.queue_size", cfg.EDDN.QueueSize, 30},
+		// Set in the file and the environment
+		{"http.root", cfg.HTTP.Root, "/env/http"},
+		// Set in the file, the environment and a flag
+		{"http.addr", cfg.HTTP.Addr, ":9002"},
+		{"eddn.workers", cfg.EDDN.Workers, 5},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s = %v, expected %v", test.name, test.actual, test.expected)
+		}
+	}
+}
+
+func TestLoadEnvironmentOverDefaults(t *testing.T) {
+	cfg, err := load(t, nil, map[string]string{"EDDP_API_DATA_DIR": "/env", "EDDP_API_IMPORT_SOURCE": "edsm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataDir != "/env" || cfg.Import.Source != "edsm" {
+		t.Errorf("data_dir = %s and import.source = %s, expected /env and edsm", cfg.DataDir, cfg.Import.Source)
+	}
+	if cfg.HTTP.Addr != Defaults().HTTP.Addr {
+		t.Errorf("http.addr = %s, expected the default %s", cfg.HTTP.Addr, Defaults().HTTP.Addr)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		args []string
+		env  map[string]string
+	}{
+		{nil, map[string]string{"EDDP_API_EDDN_WORKERS": "many"}},
+		{nil, map[string]string{"EDDP_API_EDDN_WORKERS": "0"}},
+		{[]string{"-eddn-workers", "-1"}, nil},
+		{[]string{"-import-source", "eddi"}, nil},
+		{[]string{"-config", "/nonexistent/eddp.json"}, nil},
+	}
+	for _, test := range tests {
+		_, err := load(t, test.args, test.env)
+		if err == nil {
+			t.Errorf("Load with %v and %v succeeded, expected an error", test.args, test.env)
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eddp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	emptyFile := filepath.Join(dir, "empty")
+	err = ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(emptyFile, []byte("\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file     string
+		expected string
+		valid    bool
+	}{
+		{"", "", true},
+		{tokenFile, "secret", true},
+		{emptyFile, "", false},
+		{filepath.Join(dir, "missing"), "", false},
+	}
+	for _, test := range tests {
+		eddn := EDDNConfig{AdminTokenFile: test.file}
+		token, err := eddn.AdminToken()
+		if (err == nil) != test.valid || token != test.expected {
+			t.Errorf("AdminToken from %q = %q, %v, expected %q and valid %v", test.file, token, err, test.expected, test.valid)
+		}
+	}
+}
@@ -460,3 +460,56 @@ var CommodityIDs = map[string]int{
 	"Unknown Probe":                 315,
 	"Precious Gems":                 316,
 }
+
+var Atmospheres = map[string]string{
+	"ammonia":           "Ammonia",
+	"ammoniaoxygen":     "Ammonia and oxygen",
+	"ammoniarich":       "Ammonia-rich",
+	"argon":             "Argon",
+	"argonrich":         "Argon-rich",
+	"carbondioxide":     "Carbon dioxide",
+	"carbondioxiderich": "Carbon dioxide-rich",
+	"earthlike":         "Suitable for water-based life",
+	"helium":            "Helium",
+	"metallicvapour":    "Metallic vapour",
+	"methane":           "Methane",
+	"methanerich":       "Methane-rich",
+	"neon":              "Neon",
+	"neonrich":          "Neon-rich",
+	"nitrogen":          "Nitrogen",
+	"oxygen":            "Oxygen",
+	"silicatevapour":    "Silicate vapour",
+	"sulphurdioxide":    "Sulphur dioxide",
+	"water":             "Water",
+	"waterrich":         "Water-rich",
+}
+
+var AtmosphereComponents = map[string]string{
+	"ammonia":        "Ammonia",
+	"argon":          "Argon",
+	"carbondioxide":  "Carbon dioxide",
+	"helium":         "Helium",
+	"hydrogen":       "Hydrogen",
+	"iron":           "Iron",
+	"methane":        "Methane",
+	"neon":           "Neon",
+	"nitrogen":       "Nitrogen",
+	"oxygen":         "Oxygen",
+	"silicates":      "Silicates",
+	"sulphurdioxide": "Sulphur dioxide",
+	"water":          "Water",
+}
+
+var SolidComponents = map[string]string{
+	"ice":   "Ice",
+	"metal": "Metal",
+	"rock":  "Rock",
+}
+
+var Reserves = map[string]string{
+	"pristineresources": "Pristine",
+	"majorresources":    "Major",
+	"commonresources":   "Common",
+	"lowresources":      "Low",
+	"depletedresources": "Depleted",
+}
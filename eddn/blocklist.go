@@ -0,0 +1,196 @@
+package eddn
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockRule blocks messages from a client.  Versions is a space-separated list of constraints
+// such as ">=1.2 <1.4.1", all of which must hold; an empty Versions or Schema matches anything
+type BlockRule struct {
+	SoftwareName string `json:"softwareName"`
+	Versions     string `json:"versions,omitempty"`
+	Schema       string `json:"schema,omitempty"`
+	Reason       string `json:"reason"`
+	Drops        uint64 `json:"drops"`
+
+	constraints []versionConstraint
+}
+
+type versionConstraint struct {
+	operator string
+	version  string
+}
+
+// Blocklist is a set of rules that can be safely replaced while in use
+type Blocklist struct {
+	mutex sync.RWMutex
+	rules []*BlockRule
+}
+
+// Load replaces the rules with those in the given file.  If the file cannot be read then the
+// existing rules are kept.  Drop counts are carried over for rules that have not changed
+func (b *Blocklist) Load(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Rules []*BlockRule `json:"rules"`
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return err
+	}
+	for _, rule := range file.Rules {
+		if rule.SoftwareName == "" {
+			return errors.New("Blocklist rule without softwareName")
+		}
+		rule.constraints, err = parseVersionConstraints(rule.Versions)
+		if err != nil {
+			return errors.New("Blocklist rule for " + rule.SoftwareName + ": " + err.Error())
+		}
+		rule.Drops = 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, rule := range file.Rules {
+		for _, oldRule := range b.rules {
+			if rule.SoftwareName == oldRule.SoftwareName && rule.Versions == oldRule.Versions && rule.Schema == oldRule.Schema {
+				rule.Drops = atomic.LoadUint64(&oldRule.Drops)
+			}
+		}
+	}
+	b.rules = file.Rules
+	return nil
+}
+
+// Blocked returns the rule that blocks a message, if any, and counts the drop against it
+func (b *Blocklist) Blocked(softwareName string, softwareVersion string, schema string) *BlockRule {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, rule := range b.rules {
+		if rule.Matches(softwareName, softwareVersion, schema) {
+			atomic.AddUint64(&rule.Drops, 1)
+			return rule
+		}
+	}
+	return nil
+}
+
+// Rules returns a copy of the current rules
+func (b *Blocklist) Rules() []BlockRule {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	rules := make([]BlockRule, len(b.rules))
+	for i, rule := range b.rules {
+		rules[i] = BlockRule{
+			SoftwareName: rule.SoftwareName,
+			Versions:     rule.Versions,
+			Schema:       rule.Schema,
+			Reason:       rule.Reason,
+			Drops:        atomic.LoadUint64(&rule.Drops),
+		}
+	}
+	return rules
+}
+
+func (r *BlockRule) Matches(softwareName string, softwareVersion string, schema string) bool {
+	if r.SoftwareName != softwareName {
+		return false
+	}
+	if r.Schema != "" && r.Schema != schema {
+		return false
+	}
+	for _, constraint := range r.constraints {
+		comparison := CompareVersions(softwareVersion, constraint.version)
+		switch constraint.operator {
+		case "<":
+			if comparison >= 0 {
+				return false
+			}
+		case "<=":
+			if comparison > 0 {
+				return false
+			}
+		case ">":
+			if comparison <= 0 {
+				return false
+			}
+		case ">=":
+			if comparison < 0 {
+				return false
+			}
+		case "=":
+			if comparison != 0 {
+				return false
+			}
+		case "!=":
+			if comparison == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func parseVersionConstraints(versions string) ([]versionConstraint, error) {
+	var constraints []versionConstraint
+	for _, field := range strings.Fields(versions) {
+		constraint := versionConstraint{operator: "="}
+		for _, operator := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(field, operator) {
+				constraint.operator = operator
+				field = strings.TrimPrefix(field, operator)
+				break
+			}
+		}
+		if field == "" {
+			return nil, errors.New("Invalid version constraint " + versions)
+		}
+		constraint.version = field
+		constraints = append(constraints, constraint)
+	}
+	return constraints, nil
+}
+
+// CompareVersions compares two dotted version strings, returning -1, 0 or 1.  Numeric parts are
+// compared numerically and anything else as text; missing parts count as zero
+func CompareVersions(a string, b string) int {
+	aParts := strings.Split(strings.TrimPrefix(strings.ToLower(a), "v"), ".")
+	bParts := strings.Split(strings.TrimPrefix(strings.ToLower(b), "v"), ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart := "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		bPart := "0"
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		aNum, aErr := strconv.ParseInt(aPart, 10, 64)
+		bNum, bErr := strconv.ParseInt(bPart, 10, 64)
+		if aErr == nil && bErr == nil {
+			if aNum < bNum {
+				return -1
+			}
+			if aNum > bNum {
+				return 1
+			}
+			continue
+		}
+		if aPart < bPart {
+			return -1
+		}
+		if aPart > bPart {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package eddn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"1.2", "1.2", 0},
+		{"1.2", "1.2.0", 0},
+		{"v1.2", "1.2", 0},
+		{"1.2", "1.3", -1},
+		{"1.10", "1.9", 1},
+		{"1.4.1", "1.4", 1},
+		{"2", "1.99.99", 1},
+		{"1.2.beta", "1.2.alpha", 1},
+		{"1.2.beta", "1.2.BETA", 0},
+	}
+	for _, test := range tests {
+		actual := CompareVersions(test.a, test.b)
+		if actual != test.expected {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", test.a, test.b, actual, test.expected)
+		}
+	}
+}
+
+func TestParseVersionConstraints(t *testing.T) {
+	tests := []struct {
+		versions string
+		expected []versionConstraint
+		valid    bool
+	}{
+		{"", nil, true},
+		{"1.2", []versionConstraint{{"=", "1.2"}}, true},
+		{">=1.2 <1.4.1", []versionConstraint{{">=", "1.2"}, {"<", "1.4.1"}}, true},
+		{"  <=2  !=1.5 ", []versionConstraint{{"<=", "2"}, {"!=", "1.5"}}, true},
+		{">1 =1.3", []versionConstraint{{">", "1"}, {"=", "1.3"}}, true},
+		{">=", nil, false},
+		{">=1.2 <", nil, false},
+	}
+	for _, test := range tests {
+		actual, err := parseVersionConstraints(test.versions)
+		if test.valid {
+			if err != nil {
+				t.Errorf("parseVersionConstraints(%q) failed: %v", test.versions, err)
+			} else if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("parseVersionConstraints(%q) = %v, expected %v", test.versions, actual, test.expected)
+			}
+		} else if err == nil {
+			t.Errorf("parseVersionConstraints(%q) = %v, expected an error", test.versions, actual)
+		}
+	}
+}
+
+func TestBlockRuleMatches(t *testing.T) {
+	constraints, err := parseVersionConstraints(">=1.2 <1.4.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := BlockRule{SoftwareName: "EDCE", Versions: ">=1.2 <1.4.1", constraints: constraints}
+	tests := []struct {
+		softwareName    string
+		softwareVersion string
+		expected        bool
+	}{
+		{"EDCE", "1.1.9", false},
+		{"EDCE", "1.2", true},
+		{"EDCE", "1.4.0", true},
+		{"EDCE", "1.4.1", false},
+		{"EDCE", "1.10", false},
+		{"EDDI", "1.3", false},
+	}
+	for _, test := range tests {
+		actual := rule.Matches(test.softwareName, test.softwareVersion, "")
+		if actual != test.expected {
+			t.Errorf("Matches(%q, %q) = %v, expected %v", test.softwareName, test.softwareVersion, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package eddn
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DedupCache remembers the messages handled within a time window, so that the same event
+// uploaded by several tools, or redelivered by EDDN, is only handled once
+type DedupCache struct {
+	window     time.Duration
+	duplicates uint64
+
+	mutex     sync.Mutex
+	seen      map[string]time.Time
+	lastPurge time.Time
+}
+
+func NewDedupCache(window time.Duration) *DedupCache {
+	return &DedupCache{
+		window:    window,
+		seen:      make(map[string]time.Time),
+		lastPurge: time.Now(),
+	}
+}
+
+// Seen reports whether a message with the given key was added within the window, and counts
+// it as a duplicate if so
+func (c *DedupCache) Seen(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	added, ok := c.seen[key]
+	if ok && time.Since(added) < c.window {
+		atomic.AddUint64(&c.duplicates, 1)
+		return true
+	}
+	return false
+}
+
+// Add records that a message with the given key has been handled
+func (c *DedupCache) Add(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	c.seen[key] = now
+	if now.Sub(c.lastPurge) >= c.window {
+		for k, added := range c.seen {
+			if now.Sub(added) >= c.window {
+				delete(c.seen, k)
+			}
+		}
+		c.lastPurge = now
+	}
+}
+
+// Duplicates returns the number of duplicate messages seen
+func (c *DedupCache) Duplicates() uint64 {
+	return atomic.LoadUint64(&c.duplicates)
+}
+
+// DedupKey identifies a message by its schema, uploader, event timestamp and content.  The
+// content is hashed in a canonical form so that clients which order or space their JSON
+// differently still produce the same key
+func (e *Envelope) DedupKey() (string, error) {
+	var message map[string]interface{}
+	err := json.Unmarshal(e.Message, &message)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	hash := fnv.New128a()
+	hash.Write(canonical)
+	return fmt.Sprintf("%s|%s|%v|%s", e.SchemaRef, e.Header.UploaderID, message["timestamp"], hex.EncodeToString(hash.Sum(nil))), nil
+}
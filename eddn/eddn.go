@@ -0,0 +1,471 @@
+package eddn
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Schemas that we understand
+const (
+	JournalSchema            = "https://eddn.edcd.io/schemas/journal/1"
+	FSSDiscoveryScanSchema   = "https://eddn.edcd.io/schemas/fssdiscoveryscan/1"
+	FSSAllBodiesFoundSchema  = "https://eddn.edcd.io/schemas/fssallbodiesfound/1"
+	NavRouteSchema           = "https://eddn.edcd.io/schemas/navroute/1"
+	NavBeaconScanSchema      = "https://eddn.edcd.io/schemas/navbeaconscan/1"
+	CodexEntrySchema         = "https://eddn.edcd.io/schemas/codexentry/1"
+	ApproachSettlementSchema = "https://eddn.edcd.io/schemas/approachsettlement/1"
+	CommoditySchema          = "https://eddn.edcd.io/schemas/commodity/3"
+	OutfittingSchema         = "https://eddn.edcd.io/schemas/outfitting/2"
+)
+
+// Envelope is the outer part of every EDDN message.  The message itself is decoded
+// separately once we know its schema
+type Envelope struct {
+	SchemaRef string          `json:"$schemaRef"`
+	Header    Header          `json:"header"`
+	Message   json.RawMessage `json:"message"`
+}
+
+type Header struct {
+	UploaderID       string `json:"uploaderID"`
+	SoftwareName     string `json:"softwareName"`
+	SoftwareVersion  string `json:"softwareVersion"`
+	GatewayTimestamp string `json:"gatewayTimestamp"`
+	GameVersion      string `json:"gameversion"`
+	GameBuild        string `json:"gamebuild"`
+}
+
+// Galaxies that a message can come from
+const (
+	GalaxyLive   = "live"
+	GalaxyLegacy = "legacy"
+	GalaxyBeta   = "beta"
+)
+
+// Galaxy works out which galaxy a message comes from.  Beta messages are sent to test schemas
+// and usually say so in their game version; legacy messages come from the Horizons 3.8 client,
+// or from the legacy Frontier API.  Messages without a game version predate the split and are
+// taken to be live
+func (e *Envelope) Galaxy() string {
+	gameVersion := strings.ToLower(e.Header.GameVersion)
+	if strings.HasSuffix(e.SchemaRef, "/test") || strings.Contains(gameVersion, "beta") {
+		return GalaxyBeta
+	}
+	if strings.HasPrefix(gameVersion, "capi-legacy") {
+		return GalaxyLegacy
+	}
+	if strings.HasPrefix(gameVersion, "capi-") || gameVersion == "" {
+		return GalaxyLive
+	}
+	if CompareVersions(gameVersion, "4") < 0 {
+		return GalaxyLegacy
+	}
+	return GalaxyLive
+}
+
+// Label values are taken from messages, which anyone can send, so only those that we know of
+// are used as they are and the rest are counted together
+const OtherLabel = "other"
+
+var knownSchemas = map[string]bool{
+	JournalSchema:            true,
+	FSSDiscoveryScanSchema:   true,
+	FSSAllBodiesFoundSchema:  true,
+	NavRouteSchema:           true,
+	NavBeaconScanSchema:      true,
+	CodexEntrySchema:         true,
+	ApproachSettlementSchema: true,
+	CommoditySchema:          true,
+	OutfittingSchema:         true,
+}
+
+// The software that sends the bulk of EDDN's messages
+var knownSoftware = map[string]bool{
+	"E:D Market Connector [Windows]": true,
+	"E:D Market Connector [Linux]":   true,
+	"E:D Market Connector [Mac OS]":  true,
+	"EDDI":                           true,
+	"EDDiscovery":                    true,
+	"EDDLite":                        true,
+	"EDSM":                           true,
+	"GameGlass":                      true,
+	"Journal Limpet":                 true,
+}
+
+// SchemaLabel gives the schema as a metric label
+func (e *Envelope) SchemaLabel() string {
+	if knownSchemas[e.SchemaRef] {
+		return e.SchemaRef
+	}
+	return OtherLabel
+}
+
+// SoftwareLabel gives the sending software as a metric label
+func (e *Envelope) SoftwareLabel() string {
+	if knownSoftware[e.Header.SoftwareName] {
+		return e.Header.SoftwareName
+	}
+	return OtherLabel
+}
+
+// DecodeEnvelope decodes and validates the outer part of an EDDN message
+func DecodeEnvelope(msg []byte) (*Envelope, error) {
+	var envelope Envelope
+	err := json.Unmarshal(msg, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.SchemaRef == "" {
+		return nil, errors.New("Missing $schemaRef")
+	}
+	if envelope.Header.SoftwareName == "" {
+		return nil, errors.New("Missing softwareName")
+	}
+	if len(envelope.Message) == 0 {
+		return nil, errors.New("Missing message")
+	}
+	return &envelope, nil
+}
+
+// Decode decodes the message in to the given structure and validates it.  Messages that carry
+// a timestamp have their event time resolved against the gateway timestamp
+func (e *Envelope) Decode(v Validator) error {
+	err := json.Unmarshal(e.Message, v)
+	if err != nil {
+		return err
+	}
+	err = v.Validate()
+	if err != nil {
+		return err
+	}
+	if t, ok := v.(timed); ok {
+		return t.resolveTime(e.Header.GatewayTimestamp)
+	}
+	return nil
+}
+
+type Validator interface {
+	Validate() error
+}
+
+func validateSystem(name string, starPos []float64) error {
+	if name == "" {
+		return errors.New("Missing system name")
+	}
+	if len(starPos) != 3 {
+		return errors.New("Invalid StarPos")
+	}
+	return nil
+}
+
+// JournalEvent is the part of a journal message that tells us which event it is
+type JournalEvent struct {
+	Event string `json:"event"`
+}
+
+func (e *JournalEvent) Validate() error {
+	if e.Event == "" {
+		return errors.New("Missing event")
+	}
+	return nil
+}
+
+// Faction is sent as a plain name by older clients and as an object by newer ones
+type Faction struct {
+	Name         string `json:"Name"`
+	FactionState string `json:"FactionState"`
+}
+
+func (f *Faction) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		f.Name = name
+		return nil
+	}
+	type faction Faction
+	return json.Unmarshal(data, (*faction)(f))
+}
+
+type FSDJumpEvent struct {
+	EventTime
+	StarSystem       string    `json:"StarSystem"`
+	StarPos          []float64 `json:"StarPos"`
+	SystemSecurity   string    `json:"SystemSecurity"`
+	SystemAllegiance string    `json:"SystemAllegiance"`
+	SystemEconomy    string    `json:"SystemEconomy"`
+	SystemGovernment string    `json:"SystemGovernment"`
+	FactionState     string    `json:"FactionState"`
+	Population       int64     `json:"Population"`
+}
+
+func (e *FSDJumpEvent) Validate() error {
+	return validateSystem(e.StarSystem, e.StarPos)
+}
+
+type DockedEvent struct {
+	EventTime
+	StarSystem        string    `json:"StarSystem"`
+	StarPos           []float64 `json:"StarPos"`
+	StationName       string    `json:"StationName"`
+	StationFaction    *Faction  `json:"StationFaction"`
+	StationAllegiance *string   `json:"StationAllegiance"`
+	StationEconomy    string    `json:"StationEconomy"`
+	StationGovernment string    `json:"StationGovernment"`
+	FactionState      string    `json:"FactionState"`
+}
+
+func (e *DockedEvent) Validate() error {
+	if e.StationName == "" {
+		return errors.New("Missing StationName")
+	}
+	return validateSystem(e.StarSystem, e.StarPos)
+}
+
+type Material struct {
+	Name    string  `json:"Name"`
+	Percent float64 `json:"Percent"`
+}
+
+// Materials are sent as a list by current clients and as a name-to-percentage object by older ones
+type Materials []Material
+
+func (m *Materials) UnmarshalJSON(data []byte) error {
+	var list []Material
+	if json.Unmarshal(data, &list) == nil {
+		*m = list
+		return nil
+	}
+	var shares map[string]float64
+	err := json.Unmarshal(data, &shares)
+	if err != nil {
+		return err
+	}
+	for name, percent := range shares {
+		*m = append(*m, Material{Name: name, Percent: percent})
+	}
+	return nil
+}
+
+type ScanEvent struct {
+	EventTime
+	StarSystem            string             `json:"StarSystem"`
+	StarPos               []float64          `json:"StarPos"`
+	BodyName              string             `json:"BodyName"`
+	AgeMY                 *int64             `json:"Age_MY"`
+	Atmosphere            string             `json:"Atmosphere"`
+	AtmosphereType        *string            `json:"AtmosphereType"`
+	AtmosphereComposition []Material         `json:"AtmosphereComposition"`
+	Composition           map[string]float64 `json:"Composition"`
+	DistanceFromArrivalLS *float64           `json:"DistanceFromArrivalLS"`
+	Eccentricity          *float64           `json:"Eccentricity"`
+	Gravity               *float64           `json:"Gravity"`
+	Landable              *bool              `json:"Landable"`
+	MassEM                *float64           `json:"MassEM"`
+	Materials             Materials          `json:"Materials"`
+	OrbitalInclination    *float64           `json:"OrbitalInclination"`
+	OrbitalPeriod         *float64           `json:"OrbitalPeriod"`
+	Periapsis             *float64           `json:"Periapsis"`
+	PlanetClass           string             `json:"PlanetClass"`
+	Radius                *float64           `json:"Radius"`
+	ReserveLevel          string             `json:"ReserveLevel"`
+	RotationPeriod        *float64           `json:"RotationPeriod"`
+	SemiMajorAxis         *float64           `json:"SemiMajorAxis"`
+	StarType              string             `json:"StarType"`
+	StellarMass           *float64           `json:"StellarMass"`
+	SurfacePressure       *float64           `json:"SurfacePressure"`
+	SurfaceTemperature    *float64           `json:"SurfaceTemperature"`
+	TerraformState        string             `json:"TerraformState"`
+	TidalLock             *bool              `json:"TidalLock"`
+	Volcanism             string             `json:"Volcanism"`
+}
+
+func (e *ScanEvent) Validate() error {
+	if e.BodyName == "" {
+		return errors.New("Missing BodyName")
+	}
+	return validateSystem(e.StarSystem, e.StarPos)
+}
+
+// BodyCountEvent covers the events which tell us how many bodies a system has:
+// FSSDiscoveryScan (BodyCount), FSSAllBodiesFound (Count) and NavBeaconScan (NumBodies)
+type BodyCountEvent struct {
+	EventTime
+	Event      string    `json:"event"`
+	StarSystem string    `json:"StarSystem"`
+	SystemName string    `json:"SystemName"`
+	StarPos    []float64 `json:"StarPos"`
+	BodyCount  *int64    `json:"BodyCount"`
+	Count      *int64    `json:"Count"`
+	NumBodies  *int64    `json:"NumBodies"`
+}
+
+// System returns the name of the system; the FSS events call it SystemName, but EDDN may also add StarSystem
+func (e *BodyCountEvent) System() string {
+	if e.StarSystem != "" {
+		return e.StarSystem
+	}
+	return e.SystemName
+}
+
+// Bodies returns the number of bodies in the system, and whether or not they have all been found
+func (e *BodyCountEvent) Bodies() (int64, bool) {
+	if e.Count != nil {
+		return *e.Count, true
+	}
+	if e.NumBodies != nil {
+		return *e.NumBodies, true
+	}
+	if e.BodyCount != nil {
+		return *e.BodyCount, false
+	}
+	return 0, false
+}
+
+func (e *BodyCountEvent) Validate() error {
+	if e.BodyCount == nil && e.Count == nil && e.NumBodies == nil {
+		return errors.New("Missing body count")
+	}
+	return validateSystem(e.System(), e.StarPos)
+}
+
+type NavRouteEntry struct {
+	StarSystem string    `json:"StarSystem"`
+	StarPos    []float64 `json:"StarPos"`
+	StarClass  string    `json:"StarClass"`
+}
+
+type NavRouteMessage struct {
+	EventTime
+	Route []NavRouteEntry `json:"Route"`
+}
+
+func (m *NavRouteMessage) Validate() error {
+	if len(m.Route) == 0 {
+		return errors.New("Missing route")
+	}
+	for i := range m.Route {
+		err := validateSystem(m.Route[i].StarSystem, m.Route[i].StarPos)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type CodexEntryMessage struct {
+	EventTime
+	System      string    `json:"System"`
+	StarPos     []float64 `json:"StarPos"`
+	EntryID     int64     `json:"EntryID"`
+	Name        string    `json:"Name"`
+	Category    string    `json:"Category"`
+	SubCategory string    `json:"SubCategory"`
+	Region      string    `json:"Region"`
+	BodyName    string    `json:"BodyName"`
+	Latitude    *float64  `json:"Latitude"`
+	Longitude   *float64  `json:"Longitude"`
+}
+
+func (m *CodexEntryMessage) Validate() error {
+	if m.EntryID == 0 {
+		return errors.New("Missing EntryID")
+	}
+	if m.Name == "" {
+		return errors.New("Missing Name")
+	}
+	return validateSystem(m.System, m.StarPos)
+}
+
+type ApproachSettlementMessage struct {
+	EventTime
+	StarSystem        string    `json:"StarSystem"`
+	StarPos           []float64 `json:"StarPos"`
+	Name              string    `json:"Name"`
+	MarketID          *int64    `json:"MarketID"`
+	BodyName          string    `json:"BodyName"`
+	Latitude          *float64  `json:"Latitude"`
+	Longitude         *float64  `json:"Longitude"`
+	StationFaction    *Faction  `json:"StationFaction"`
+	StationAllegiance string    `json:"StationAllegiance"`
+	StationGovernment string    `json:"StationGovernment"`
+	StationEconomy    string    `json:"StationEconomy"`
+}
+
+func (m *ApproachSettlementMessage) Validate() error {
+	if m.Name == "" {
+		return errors.New("Missing Name")
+	}
+	return validateSystem(m.StarSystem, m.StarPos)
+}
+
+// Bracket is a stock or demand bracket.  An empty string is rather surprisingly a valid
+// value, and means "not normally but at the moment yes", which we treat as bracket 3
+type Bracket int64
+
+func (b *Bracket) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		if s != "" {
+			return errors.New("Invalid bracket " + s)
+		}
+		*b = 3
+		return nil
+	}
+	var i int64
+	err := json.Unmarshal(data, &i)
+	if err != nil {
+		return err
+	}
+	*b = Bracket(i)
+	return nil
+}
+
+type Commodity struct {
+	Name          string  `json:"name"`
+	BuyPrice      int64   `json:"buyPrice"`
+	SellPrice     int64   `json:"sellPrice"`
+	Stock         int64   `json:"stock"`
+	StockBracket  Bracket `json:"stockBracket"`
+	Demand        int64   `json:"demand"`
+	DemandBracket Bracket `json:"demandBracket"`
+}
+
+type CommodityMessage struct {
+	EventTime
+	SystemName  string      `json:"systemName"`
+	StationName string      `json:"stationName"`
+	Commodities []Commodity `json:"commodities"`
+}
+
+func (m *CommodityMessage) Validate() error {
+	if m.SystemName == "" {
+		return errors.New("Missing systemName")
+	}
+	if m.StationName == "" {
+		return errors.New("Missing stationName")
+	}
+	for i := range m.Commodities {
+		if m.Commodities[i].Name == "" {
+			return errors.New("Missing commodity name")
+		}
+	}
+	return nil
+}
+
+type OutfittingMessage struct {
+	EventTime
+	SystemName  string   `json:"systemName"`
+	StationName string   `json:"stationName"`
+	Modules     []string `json:"modules"`
+}
+
+func (m *OutfittingMessage) Validate() error {
+	if m.SystemName == "" {
+		return errors.New("Missing systemName")
+	}
+	if m.StationName == "" {
+		return errors.New("Missing stationName")
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package eddn
+
+import (
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	tests := []struct {
+		schema   string
+		software string
+		expected [2]string
+	}{
+		{JournalSchema, "EDDI", [2]string{JournalSchema, "EDDI"}},
+		{CommoditySchema, "E:D Market Connector [Windows]", [2]string{CommoditySchema, "E:D Market Connector [Windows]"}},
+		{"https://eddn.edcd.io/schemas/journal/1/test", "EDDI", [2]string{OtherLabel, "EDDI"}},
+		{"https://eddn.edcd.io/schemas/shipyard/2", "EDDI 4.0", [2]string{OtherLabel, OtherLabel}},
+		{"x", "", [2]string{OtherLabel, OtherLabel}},
+	}
+	for _, test := range tests {
+		envelope := Envelope{SchemaRef: test.schema, Header: Header{SoftwareName: test.software}}
+		actual := [2]string{envelope.SchemaLabel(), envelope.SoftwareLabel()}
+		if actual != test.expected {
+			t.Errorf("Labels for %q from %q = %q, expected %q", test.schema, test.software, actual, test.expected)
+		}
+	}
+}
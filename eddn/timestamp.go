@@ -0,0 +1,103 @@
+package eddn
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// How far a message's timestamp may be from the time at which the gateway received it
+var MaxClockSkew = 10 * time.Minute
+var MaxAge = 24 * time.Hour
+
+// Layouts that clients have been seen to send, in addition to RFC3339
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z07:00Z", // ED-IBE: 2017-01-17T20:43:33+01:00Z
+	"2006-01-02T03:04:05 PMZ",              // EVA: 2017-01-19T10:53:28 pmZ
+	"2006-01-02 15:04:05.999999999Z07:00",
+}
+
+// Layouts without a zone.  Clients that send these send the player's local time, so they are
+// recognised only to be refused
+var zonelessLayouts = []string{
+	"2006-01-02T15:04:05.999999999", // EDCE: 2017-01-18T15:04:04.582385, Elite G19s Companion App: 2017-01-20T09:19:13
+	"2006-01-02 15:04:05.999999999",
+}
+
+// EventTime is embedded in messages that carry a timestamp.  Time is filled in when the message
+// is decoded, from the timestamp if it can be trusted and otherwise from the gateway timestamp
+type EventTime struct {
+	Timestamp string    `json:"timestamp"`
+	Time      time.Time `json:"-"`
+}
+
+type timed interface {
+	resolveTime(gatewayTimestamp string) error
+}
+
+func (t *EventTime) resolveTime(gatewayTimestamp string) error {
+	var err error
+	t.Time, err = ResolveTimestamp(t.Timestamp, gatewayTimestamp)
+	return err
+}
+
+// TimestampError is returned when a message's timestamp is too far from the gateway timestamp
+// to be believed
+type TimestampError struct {
+	Timestamp        string
+	GatewayTimestamp string
+	Reason           string
+}
+
+func (e *TimestampError) Error() string {
+	return "Timestamp " + e.Timestamp + " is " + e.Reason + " (gateway timestamp " + e.GatewayTimestamp + ")"
+}
+
+// ParseTimestamp parses a timestamp in any of the formats that clients are known to send.  A
+// timestamp without a zone is an error, as there is no telling which zone it is in
+func ParseTimestamp(timestamp string) (time.Time, error) {
+	timestamp = strings.TrimSpace(timestamp)
+	if timestamp == "" {
+		return time.Time{}, errors.New("Missing timestamp")
+	}
+	// Some clients send lower-case T, Z or PM
+	upper := strings.ToUpper(timestamp)
+	for _, layout := range timestampLayouts {
+		t, err := time.Parse(layout, upper)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	for _, layout := range zonelessLayouts {
+		_, err := time.Parse(layout, upper)
+		if err == nil {
+			return time.Time{}, errors.New("Timestamp " + timestamp + " has no time zone")
+		}
+	}
+	return time.Time{}, errors.New("Unrecognised timestamp " + timestamp)
+}
+
+// ResolveTimestamp works out when an event happened.  A client timestamp that cannot be parsed,
+// or that has no zone, is replaced by the gateway timestamp, and one that is too far from the gateway timestamp
+// results in a TimestampError.  Without a gateway timestamp the client timestamp is used as-is
+func ResolveTimestamp(timestamp string, gatewayTimestamp string) (time.Time, error) {
+	eventTime, err := ParseTimestamp(timestamp)
+	if gatewayTimestamp == "" {
+		return eventTime, err
+	}
+	gatewayTime, gatewayErr := ParseTimestamp(gatewayTimestamp)
+	if gatewayErr != nil {
+		return eventTime, err
+	}
+	if err != nil {
+		return gatewayTime, nil
+	}
+	if eventTime.After(gatewayTime.Add(MaxClockSkew)) {
+		return eventTime, &TimestampError{Timestamp: timestamp, GatewayTimestamp: gatewayTimestamp, Reason: "in the future"}
+	}
+	if eventTime.Before(gatewayTime.Add(-MaxAge)) {
+		return eventTime, &TimestampError{Timestamp: timestamp, GatewayTimestamp: gatewayTimestamp, Reason: "too old"}
+	}
+	return eventTime, nil
+}
@@ -0,0 +1,80 @@
+package eddn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		timestamp string
+		expected  time.Time
+		valid     bool
+	}{
+		{"2017-01-18T15:04:04Z", time.Date(2017, 1, 18, 15, 4, 4, 0, time.UTC), true},
+		{"2017-01-18T15:04:04.582385Z", time.Date(2017, 1, 18, 15, 4, 4, 582385000, time.UTC), true},
+		{"2017-01-18t15:04:04z", time.Date(2017, 1, 18, 15, 4, 4, 0, time.UTC), true},
+		{" 2017-01-18T16:04:04+01:00 ", time.Date(2017, 1, 18, 15, 4, 4, 0, time.UTC), true},
+		// ED-IBE
+		{"2017-01-17T20:43:33+01:00Z", time.Date(2017, 1, 17, 19, 43, 33, 0, time.UTC), true},
+		// EVA
+		{"2017-01-19T10:53:28 pmZ", time.Date(2017, 1, 19, 22, 53, 28, 0, time.UTC), true},
+		{"2017-01-18 15:04:04+00:00", time.Date(2017, 1, 18, 15, 4, 4, 0, time.UTC), true},
+		// EDCE and Elite G19s Companion App send local time without a zone
+		{"2017-01-18T15:04:04.582385", time.Time{}, false},
+		{"2017-01-20T09:19:13", time.Time{}, false},
+		{"2017-01-20 09:19:13", time.Time{}, false},
+		{"", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, test := range tests {
+		actual, err := ParseTimestamp(test.timestamp)
+		if test.valid {
+			if err != nil {
+				t.Errorf("ParseTimestamp(%q) failed: %v", test.timestamp, err)
+			} else if !actual.Equal(test.expected) {
+				t.Errorf("ParseTimestamp(%q) = %v, expected %v", test.timestamp, actual, test.expected)
+			}
+		} else if err == nil {
+			t.Errorf("ParseTimestamp(%q) = %v, expected an error", test.timestamp, actual)
+		}
+	}
+}
+
+func TestResolveTimestamp(t *testing.T) {
+	gateway := "2017-01-20T09:19:13.123456Z"
+	gatewayTime := time.Date(2017, 1, 20, 9, 19, 13, 123456000, time.UTC)
+	tests := []struct {
+		timestamp        string
+		gatewayTimestamp string
+		expected         time.Time
+		valid            bool
+	}{
+		{"2017-01-20T09:18:00Z", gateway, time.Date(2017, 1, 20, 9, 18, 0, 0, time.UTC), true},
+		{"2017-01-20T09:25:00Z", gateway, time.Date(2017, 1, 20, 9, 25, 0, 0, time.UTC), true},
+		{"2017-01-19T09:20:00Z", gateway, time.Date(2017, 1, 19, 9, 20, 0, 0, time.UTC), true},
+		// Too far ahead or behind of the gateway
+		{"2017-01-20T09:30:00Z", gateway, time.Time{}, false},
+		{"2017-01-19T09:19:00Z", gateway, time.Time{}, false},
+		// Timestamps that can't be used are replaced by the gateway's
+		{"2017-01-20T10:19:13", gateway, gatewayTime, true},
+		{"2017-01-18T15:04:04.582385", gateway, gatewayTime, true},
+		{"2017-01-19T10:53:28 pmX", gateway, gatewayTime, true},
+		{"", gateway, gatewayTime, true},
+		// Without a gateway timestamp the client's has to do
+		{"2017-01-20T09:18:00Z", "", time.Date(2017, 1, 20, 9, 18, 0, 0, time.UTC), true},
+		{"2017-01-20T09:19:13", "", time.Time{}, false},
+	}
+	for _, test := range tests {
+		actual, err := ResolveTimestamp(test.timestamp, test.gatewayTimestamp)
+		if test.valid {
+			if err != nil {
+				t.Errorf("ResolveTimestamp(%q, %q) failed: %v", test.timestamp, test.gatewayTimestamp, err)
+			} else if !actual.Equal(test.expected) {
+				t.Errorf("ResolveTimestamp(%q, %q) = %v, expected %v", test.timestamp, test.gatewayTimestamp, actual, test.expected)
+			}
+		} else if err == nil {
+			t.Errorf("ResolveTimestamp(%q, %q) = %v, expected an error", test.timestamp, test.gatewayTimestamp, actual)
+		}
+	}
+}
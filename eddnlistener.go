@@ -1,33 +1,132 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
 	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"./config"
 	"./dataDefs"
-	_ "github.com/mattn/go-sqlite3" // SQLite driver
-	zmq "github.com/pebbe/zmq4"     // ZeroMQ
+	"./eddn"
+	"./importer"
+	"./logging"
+	_ "github.com/mattn/go-sqlite3"                  // SQLite driver
+	zmq "github.com/pebbe/zmq4"                      // ZeroMQ
+	"github.com/prometheus/client_golang/prometheus" // Metrics
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Constants
-var dataDir string = config.GetEnvWithDefault("EDDP_API_DATA_DIR", "./data")
-var eddnListenerURL string = config.GetEnvWithDefault("EDDP_API_EDDN_LISTENER_URL", "tcp://eddn.edcd.io:9500")
-var eddnPublisherURL string = config.GetEnvWithDefault("EDDP_API_EDDN_PUBLISHER_URL", "tcp://*:5556")
-var msgChannelBufferCount int = 100
+// Configuration, loaded at startup
+var cfg *config.Config
+
+// Limits on the wait between attempts to reconnect to EDDN
+const minReconnectBackoff = time.Second
+const maxReconnectBackoff = 5 * time.Minute
+
+// Clients whose messages we ignore
+var blocklist eddn.Blocklist
+
+// Messages handled recently
+var dedupCache *eddn.DedupCache
+
+// GalaxyFilter is what we do with messages from a galaxy, and how many messages it has seen
+type GalaxyFilter struct {
+	Galaxy   string `json:"galaxy"`
+	Decision string `json:"decision"`
+	Messages uint64 `json:"messages"`
+}
+
+// Only the live galaxy is of interest; beta and legacy data describe a different universe
+var galaxyFilters = []*GalaxyFilter{
+	{Galaxy: eddn.GalaxyLive, Decision: "accepted"},
+	{Galaxy: eddn.GalaxyBeta, Decision: "dropped"},
+	{Galaxy: eddn.GalaxyLegacy, Decision: "ignored"},
+}
 
 // Database connections
 var eddpDb *sql.DB
+var deadLetterDb *sql.DB
+
+// Guards the publisher socket
+var publisherMutex sync.Mutex
+
+// Held for reading while a worker handles a message, and for writing while the database is
+// swapped, so that handling pauses meanwhile
+var handlingMutex sync.RWMutex
+
+// The archive being written, if any
+var messageArchive *Archive
+
+// The token that must be given to swap databases; swapping is disabled without one
+var adminToken string
+
+// Metrics, served by the admin server
+var metricsRegistry = prometheus.NewRegistry()
+var metrics = promauto.With(metricsRegistry)
+var messagesReceived = metrics.NewCounterVec(prometheus.CounterOpts{
+	Name: "eddnlistener_messages_received_total",
+	Help: "EDDN messages received, by schema and sending software, with those we do not know of counted as other.",
+}, []string{"schema", "software"})
+var messageOutcomes = metrics.NewCounterVec(prometheus.CounterOpts{
+	Name: "eddnlistener_messages_total",
+	Help: "EDDN messages by outcome: accepted, blocked, beta, legacy, duplicate or rejected.",
+}, []string{"outcome"})
+var messagesRejected = metrics.NewCounterVec(prometheus.CounterOpts{
+	Name: "eddnlistener_messages_rejected_total",
+	Help: "EDDN messages rejected, by reason.",
+}, []string{"reason"})
+var handlerSeconds = metrics.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "eddnlistener_handler_duration_seconds",
+	Help:    "Time taken to handle an EDDN message, by schema.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"schema"})
+var dbWriteErrors = metrics.NewCounter(prometheus.CounterOpts{
+	Name: "eddnlistener_db_write_errors_total",
+	Help: "Database writes that failed.",
+})
+
+// What the listener is up to, for the admin server.  Times are Unix nanoseconds, and are read
+// and written atomically
+var feedLastReceived int64
+var feedOutageStart int64
+var lastHandled int64
+var lastWritten int64
+
+// Messages received but not yet passed to a worker
+var messageQueue chan [][]byte
+
+// Systems, bodies and stations that we discover are given negative IDs, from here downwards, so
+// that they can never clash with imported IDs, which are positive.  eddp-admin rebuild maps them
+// to the imported IDs once the source knows about them
+const localIdBase = -1
+
+// Serialises the allocation of local IDs
+var localIdMutex sync.Mutex
 
 type Systems struct {
 	System []struct {
@@ -35,971 +134,2159 @@ type Systems struct {
 	}
 }
 
-func assertNil(e error) {
-	if e != nil {
-		log.Print(e)
-		panic(e)
-	}
-}
-
 func errFound(e error, msg string) bool {
 	if e != nil {
-		log.Print(e)
-		log.Print(msg)
+		logging.Error(msg, logging.Fields{"error": e})
 		return true
 	}
 	return false
 }
 
 func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-
-	for {
-		var err error
-		eddpDb, err = sql.Open("sqlite3", dataDir+"/sqlite/eddp.sqlite")
-		if err != nil {
-			log.Print(err)
-		}
-		defer eddpDb.Close()
-
-		subscriber, _ := zmq.NewSocket(zmq.SUB)
-		defer subscriber.Close()
-		subscriber.Connect(eddnListenerURL)
-		subscriber.SetSubscribe("")
+	reprocess := flag.Bool("reprocess", false, "Run previously rejected messages through the handlers again, then exit")
+	reprocessReason := flag.String("reason", "", "Only reprocess messages that were rejected for this reason")
+	replay := flag.Bool("replay", false, "Run the messages in the given archive files through the handlers, then exit")
+	realtime := flag.Bool("realtime", false, "Replay messages at the pace at which they were originally received")
+	var err error
+	cfg, err = config.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", logging.Fields{"error": err})
+	}
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
+	logging.Info("Configuration", logging.Fields{"config": cfg})
 
-		publisher, _ := zmq.NewSocket(zmq.PUB)
-		publisher.Bind(eddnPublisherURL)
-		defer publisher.Close()
+	runtime.GOMAXPROCS(runtime.NumCPU())
 
-		msgChannel := make(chan [][]byte, msgChannelBufferCount)
-		quitChannel := make(chan bool)
-		go HandlerLoop(publisher, msgChannel, quitChannel)
+	eddn.MaxClockSkew = time.Duration(cfg.EDDN.MaxClockSkew) * time.Second
+	eddn.MaxAge = time.Duration(cfg.EDDN.MaxMessageAge) * time.Second
+	dedupCache = eddn.NewDedupCache(time.Duration(cfg.EDDN.DedupWindow) * time.Second)
 
-		for {
-			raw, err := subscriber.RecvMessageBytes(0)
-			if err != nil {
-				quitChannel <- true
-				break
-			}
-			msgChannel <- raw
-		}
+	// Without its rules we would accept everything that the blocklist is there to keep out; on a
+	// reload the old rules are kept instead
+	err = blocklist.Load(cfg.EDDN.Blocklist)
+	if err != nil {
+		logging.Fatal("Failed to load blocklist", logging.Fields{"file": cfg.EDDN.Blocklist, "error": err})
 	}
-}
 
-func HandlerLoop(publisher *zmq.Socket, msgChannel chan [][]byte, quitChannel chan bool) {
-	for {
-		select {
-		case <-quitChannel:
-			break
-		case raw := <-msgChannel:
-			{
-				go func() {
-					var msg bytes.Buffer
-					r, _ := zlib.NewReader(bytes.NewReader(raw[0]))
-					// TODO: not convinced we need this copy -- pass interfaces instead
-					io.Copy(&msg, r)
-					r.Close()
-					HandleMessage(&msg, publisher)
-				}()
-			}
-		}
+	deadLetterDb, err = sql.Open("sqlite3", cfg.DataDir+"/sqlite/deadletter.sqlite")
+	if err != nil {
+		logging.Error("Failed to open dead letter database", logging.Fields{"error": err})
 	}
-}
+	defer deadLetterDb.Close()
+	SetupDeadLetterTables()
 
-func HandleMessage(msg *bytes.Buffer, publisher *zmq.Socket) {
-	// Turn the message in to JSON
-	d := json.NewDecoder(strings.NewReader(msg.String()))
-	d.UseNumber()
-	var data map[string]interface{}
-	err := d.Decode(&data)
-	if errFound(err, msg.String()) {
+	if *reprocess {
+		eddpDb, err = sql.Open("sqlite3", cfg.DataDir+"/sqlite/eddp.sqlite")
+		if err != nil {
+			logging.Fatal("Failed to open database", logging.Fields{"error": err})
+		}
+		defer eddpDb.Close()
+		SetupTables(eddpDb)
+		Reprocess(*reprocessReason)
 		return
 	}
 
-	// Check to see if it is interesting to us and not blocked
-	clientName := data["header"].(map[string]interface{})["softwareName"].(string)
-	clientVersion := data["header"].(map[string]interface{})["softwareVersion"].(string)
-	if !ClientAllowed(clientName, clientVersion) {
+	if *replay {
+		eddpDb, err = sql.Open("sqlite3", cfg.DataDir+"/sqlite/eddp.sqlite")
+		if err != nil {
+			logging.Fatal("Failed to open database", logging.Fields{"error": err})
+		}
+		defer eddpDb.Close()
+		SetupTables(eddpDb)
+		Replay(flag.Args(), *realtime, time.Time{})
 		return
 	}
 
-	schema := data["$schemaRef"].(string)
-	if schema == "https://eddn.edcd.io/schemas/journal/1" {
-		event := data["message"].(map[string]interface{})["event"].(string)
-		if event == "FSDJump" {
-			HandleFSDJumpEvent(msg.String(), data["message"].(map[string]interface{}), publisher)
-		} else if event == "Docked" {
-			HandleDockedEvent(msg.String(), data["message"].(map[string]interface{}), publisher)
-		} else if event == "Scan" {
-			stellarMass := data["message"].(map[string]interface{})["StellarMass"]
-			if stellarMass == nil {
-				HandleBodyScanEvent(msg.String(), data["message"].(map[string]interface{}), publisher)
+	// Reload the blocklist on SIGHUP
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			err := blocklist.Load(cfg.EDDN.Blocklist)
+			if err != nil {
+				logging.Error("Failed to reload blocklist", logging.Fields{"file": cfg.EDDN.Blocklist, "error": err})
 			} else {
-				HandleStarScanEvent(msg.String(), data["message"].(map[string]interface{}), publisher)
+				logging.Info("Reloaded blocklist", logging.Fields{"file": cfg.EDDN.Blocklist})
 			}
 		}
-	} else if schema == "https://eddn.edcd.io/schemas/commodity/3" {
-		HandleCommodity3Schema(msg.String(), data["message"].(map[string]interface{}), publisher)
-	} else if schema == "https://eddn.edcd.io/schemas/outfitting/2" {
-		HandleOutfitting2Schema(msg.String(), data["message"].(map[string]interface{}), publisher)
-	}
-}
+	}()
 
-func ClientAllowed(client string, version string) bool {
-	// ED-IBE sends bad timestamps (e.g. 2017-01-17T20:43:33+01:00Z) so we can't use it
-	if client == "ED-IBE (API)" {
-		return false
+	if cfg.EDDN.ArchiveDir != "" {
+		messageArchive = NewArchive(cfg.EDDN.ArchiveDir)
 	}
-
-	// EDCE sends bad timestamps (e.g. 2017-01-18T15:04:04.582385) so we can't use it
-	if client == "EDCE" {
-		return false
+	eddpDb, err = sql.Open("sqlite3", cfg.DataDir+"/sqlite/eddp.sqlite")
+	if err != nil {
+		logging.Fatal("Failed to open database", logging.Fields{"error": err})
 	}
+	SetupTables(eddpDb)
 
-	// Elite G19s Companion App sends bad timestamps (e.g. 2017-01-20T09:19:13) so we can't use it
-	if client == "Elite G19s Companion App" {
-		return false
+	adminToken, err = cfg.EDDN.AdminToken()
+	if err != nil {
+		logging.Fatal("Failed to read admin token", logging.Fields{"file": cfg.EDDN.AdminTokenFile, "error": err})
 	}
+	go AdminServer()
 
-	// EVA [iPhone] sends bad timestamps (e.g 2017-01-19T10:53:28 pmZ) so we can't use it
-	if client == "EVA [iPhone]" {
-		return false
+	// The publisher stays bound while we reconnect to EDDN, so our own subscribers are unaffected
+	publisher, err := zmq.NewSocket(zmq.PUB)
+	if err != nil {
+		logging.Fatal("Failed to create publisher", logging.Fields{"error": err})
+	}
+	err = publisher.Bind(cfg.EDDN.PublisherURL)
+	if err != nil {
+		logging.Fatal("Failed to bind publisher", logging.Fields{"url": cfg.EDDN.PublisherURL, "error": err})
 	}
 
-	// EVA [iPad] sends bad timestamps (e.g 2017-01-19T10:53:28 pmZ) so we can't use it
-	if client == "EVA [iPad]" {
-		return false
+	// Stop taking messages from EDDN on SIGTERM or interrupt
+	stop := make(chan struct{})
+	terms := make(chan os.Signal, 1)
+	signal.Notify(terms, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-terms
+		logging.Info("Shutting down", logging.Fields{"signal": sig.String()})
+		close(stop)
+	}()
+
+	msgChannel := make(chan [][]byte, cfg.EDDN.QueueSize)
+	doneChannel := make(chan bool)
+	messageQueue = msgChannel
+	metrics.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "eddnlistener_queue_depth",
+		Help: "EDDN messages received but not yet passed to a worker.",
+	}, func() float64 { return float64(len(msgChannel)) })
+	atomic.StoreInt64(&lastHandled, time.Now().UnixNano())
+	go HandlerLoop(publisher, msgChannel, doneChannel)
+
+	NotifySystemd("READY=1")
+	go Watchdog()
+
+	Subscribe(msgChannel, stop)
+
+	// Let the workers finish what they have, but not for ever
+	close(msgChannel)
+	status := 0
+	select {
+	case <-doneChannel:
+		logging.Info("Handled all queued messages")
+	case <-time.After(time.Duration(cfg.ShutdownTimeout) * time.Second):
+		logging.Error("Gave up waiting for queued messages to be handled", logging.Fields{"timeout_seconds": cfg.ShutdownTimeout})
+		status = 1
 	}
 
-	return true
+	publisher.SetLinger(0)
+	publisher.Close()
+	eddpDb.Close()
+	deadLetterDb.Close()
+	os.Exit(status)
 }
 
-func HandleBodyScanEvent(raw string, event map[string]interface{}, publisher *zmq.Socket) {
-	systemname := event["StarSystem"].(string)
-	bodyname := event["BodyName"].(string)
-
-	// Fetch the current system from the database
-	systemx, err := Float(event["StarPos"].([]interface{})[0])
-	assertNil(err)
-	systemx = fixCoord(systemx)
-	systemy, err := Float(event["StarPos"].([]interface{})[1])
-	assertNil(err)
-	systemy = fixCoord(systemy)
-	systemz, err := Float(event["StarPos"].([]interface{})[2])
-	assertNil(err)
-	systemz = fixCoord(systemz)
-
-	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
-	if err != nil {
-		// System doesn't exist - ignore
-	} else {
-		// Turn the system in to JSON
-		d := json.NewDecoder(strings.NewReader(systemdata))
-		d.UseNumber()
-		var system map[string]interface{}
-		err = d.Decode(&system)
-		if errFound(err, raw) {
-			return
+// Subscribe receives messages from EDDN and queues them for the workers until told to stop.
+// If the connection fails, or EDDN goes quiet for longer than the liveness timeout, we
+// reconnect with exponential backoff, logging when the outage started and how long it lasted
+func Subscribe(msgChannel chan<- [][]byte, stop <-chan struct{}) {
+	timeout := time.Duration(cfg.EDDN.LivenessTimeout) * time.Second
+	backoff := minReconnectBackoff
+	lastReceived := time.Now()
+	var outageStart time.Time
+	for {
+		subscriber, err := ConnectSubscriber(timeout)
+		quietSince := time.Now()
+		for err == nil {
+			select {
+			case <-stop:
+				subscriber.Close()
+				return
+			default:
+			}
+			var raw [][]byte
+			raw, err = subscriber.RecvMessageBytes(0)
+			if zmq.AsErrno(err) == zmq.Errno(syscall.EAGAIN) {
+				// Receives time out every second so that we notice being told to stop
+				err = nil
+				if time.Since(quietSince) >= timeout {
+					err = fmt.Errorf("no message received in %v", timeout)
+				}
+				continue
+			}
+			if err != nil {
+				break
+			}
+			quietSince = time.Now()
+			lastReceived = quietSince
+			atomic.StoreInt64(&feedLastReceived, lastReceived.UnixNano())
+			if !outageStart.IsZero() {
+				logging.Info("EDDN feed restored", logging.Fields{"outage_start": outageStart.Format(time.RFC3339), "outage_seconds": int64(lastReceived.Sub(outageStart).Seconds())})
+				outageStart = time.Time{}
+				atomic.StoreInt64(&feedOutageStart, 0)
+			}
+			backoff = minReconnectBackoff
+			// This blocks if the workers fall behind, leaving messages queued in ZeroMQ
+			select {
+			case msgChannel <- raw:
+			case <-stop:
+				subscriber.Close()
+				return
+			}
+		}
+		if subscriber != nil {
+			subscriber.Close()
 		}
 
-		// Now fetch the body
-		systemId, err := Int(system["id"])
-		if errFound(err, raw) {
+		if outageStart.IsZero() {
+			outageStart = lastReceived
+			atomic.StoreInt64(&feedOutageStart, outageStart.UnixNano())
+			logging.Warn("EDDN feed lost", logging.Fields{"error": err})
+		} else {
+			logging.Warn("EDDN feed still down", logging.Fields{"outage_start": outageStart.Format(time.RFC3339), "error": err})
+		}
+		logging.Info("Reconnecting to EDDN", logging.Fields{"backoff_seconds": backoff.Seconds()})
+		select {
+		case <-time.After(backoff):
+		case <-stop:
 			return
 		}
-		body, err := FetchBody(systemId, bodyname)
-		var exists bool
-		if err != nil {
-			exists = false
-			body = make(map[string]interface{})
-			body["created_at"] = int32(time.Now().Unix())
-		} else {
-			exists = true
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
 		}
+	}
+}
 
-		body["updated_at"] = int32(time.Now().Unix())
+// ConnectSubscriber connects to EDDN.  Receives time out every second so that the caller can
+// check for silence and shutdown, and ZeroMQ heartbeats detect a connection that has died
+// without being closed
+func ConnectSubscriber(timeout time.Duration) (*zmq.Socket, error) {
+	subscriber, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		return nil, err
+	}
+	err = subscriber.SetRcvtimeo(time.Second)
+	if err == nil {
+		err = subscriber.SetLinger(0)
+	}
+	if err == nil {
+		err = subscriber.SetHeartbeatIvl(timeout / 4)
+	}
+	if err == nil {
+		err = subscriber.SetHeartbeatTimeout(timeout / 2)
+	}
+	if err == nil {
+		err = subscriber.Connect(cfg.EDDN.ListenerURL)
+	}
+	if err == nil {
+		err = subscriber.SetSubscribe("")
+	}
+	if err != nil {
+		subscriber.Close()
+		return nil, err
+	}
+	return subscriber, nil
+}
 
-		// Periapsis
-		periapsis, err := Float(event["Periapsis"])
-		if err == nil {
-			body["arg_of_periapsis"] = periapsis
-		}
-		// Distance
-		distance, err := Float(event["DistanceFromArrivalLS"])
-		if err == nil {
-			body["distance_to_arrival"] = distance
+// SetupTables creates the tables that are populated only by the listener, returning the first
+// error so that a database being swapped in can be refused
+func SetupTables(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS codex(id INTEGER PRIMARY KEY, system_id INT NOT NULL, entry_id INT NOT NULL, body_name TEXT COLLATE NOCASE NOT NULL, name TEXT COLLATE NOCASE NOT NULL, data TEXT NOT NULL)")
+	if err != nil {
+		logging.Error("Failed to create codex table", logging.Fields{"error": err})
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS codex_idx1 ON codex(system_id)")
+	if err != nil {
+		logging.Error("Failed to create codex index", logging.Fields{"error": err})
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS codex_idx2 ON codex(name)")
+	if err != nil {
+		logging.Error("Failed to create codex index", logging.Fields{"error": err})
+		return err
+	}
+	// An entry is recorded once for each system and body.  Databases from before this was
+	// enforced can have duplicates, of which we keep the latest
+	var unique bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = 'codex_idx3')").Scan(&unique)
+	if err != nil {
+		logging.Error("Failed to find codex index", logging.Fields{"error": err})
+		return err
+	}
+	if !unique {
+		_, err = db.Exec("DELETE FROM codex WHERE id NOT IN (SELECT MAX(id) FROM codex GROUP BY system_id, entry_id, body_name)")
+		if err != nil {
+			logging.Error("Failed to remove duplicate codex entries", logging.Fields{"error": err})
+			return err
 		}
-		// Eccentricity
-		eccentricity, err := Float(event["Eccentricity"])
-		if err == nil {
-			body["orbital_eccentricity"] = eccentricity
+		_, err = db.Exec("CREATE UNIQUE INDEX codex_idx3 ON codex(system_id, entry_id, body_name)")
+		if err != nil {
+			logging.Error("Failed to create codex index", logging.Fields{"error": err})
+			return err
 		}
-		// Mass
-		mass, err := Float(event["MassEM"])
-		if err == nil {
-			body["earth_masses"] = mass
+	}
+	// Databases built before systems were indexed by their co-ordinates need the index adding
+	err = importer.SetupSearchIndex(db)
+	if err != nil {
+		logging.Error("Failed to create systems search index", logging.Fields{"error": err})
+	}
+	return err
+}
+
+// SetupDeadLetterTables creates the table that holds rejected messages.  This lives in its own
+// database so that it survives rebuilds of the main one
+func SetupDeadLetterTables() {
+	_, err := deadLetterDb.Exec("CREATE TABLE IF NOT EXISTS rejected(id INTEGER PRIMARY KEY, received_at INT NOT NULL, schema TEXT NOT NULL, software_name TEXT NOT NULL, software_version TEXT NOT NULL, reason TEXT NOT NULL, error TEXT NOT NULL, message TEXT NOT NULL)")
+	if err != nil {
+		logging.Error("Failed to create rejected table", logging.Fields{"error": err})
+	}
+	_, err = deadLetterDb.Exec("CREATE INDEX IF NOT EXISTS rejected_idx1 ON rejected(reason)")
+	if err != nil {
+		logging.Error("Failed to create rejected index", logging.Fields{"error": err})
+	}
+}
+
+// StoreRejection keeps a rejected message so that it can be reprocessed later
+func StoreRejection(raw string, rejection *Rejection) {
+	_, err := deadLetterDb.Exec("INSERT INTO rejected(received_at, schema, software_name, software_version, reason, error, message) VALUES(?, ?, ?, ?, ?, ?, ?)", time.Now().Unix(), rejection.Schema, rejection.SoftwareName, rejection.SoftwareVersion, rejection.Reason, rejection.Err.Error(), raw)
+	if err != nil {
+		logging.Error("Failed to store rejected message", logging.Fields{"reason": rejection.Reason, "error": err})
+	}
+}
+
+// Reprocess runs previously rejected messages through HandleMessage again.  Messages that are
+// now handled are removed from the dead-letter store; the others have their reason updated
+func Reprocess(reason string) {
+	var handled, rejected int
+	lastId := int64(0)
+	for {
+		// Work in batches so that we aren't reading from the table while we change it
+		rows, err := deadLetterDb.Query("SELECT id, message FROM rejected WHERE id > ? AND (? = '' OR reason = ?) ORDER BY id LIMIT 1000", lastId, reason, reason)
+		if err != nil {
+			logging.Error("Failed to read rejected messages", logging.Fields{"error": err})
+			return
 		}
-		// Gravity
-		gravity, err := Float(event["Gravity"])
-		if err == nil {
-			body["gravity"] = gravity / 9.80665
-		}
-		body["group_id"] = 6
-		body["group_name"] = "Planet"
-		body["is_landable"] = event["Landable"]
-		body["is_rotational_period_tidally_locked"] = event["TidalLock"]
-		// Materials
-		if event["Materials"] != nil {
-			switch v := event["Materials"].(type) {
-			case []interface{}:
-				materials := event["Materials"].([]interface{})
-				// Build materials
-				var materialsJson []map[string]interface{}
-				materialsJson = make([]map[string]interface{}, len(materials))
-				// transform each
-				for i := range materials {
-					var materialJson map[string]interface{}
-					materialJson = make(map[string]interface{})
-
-					material := materials[i].(map[string]interface{})
-					materialJson["material_name"] = TranslateMaterial(material["Name"].(string))
-					share, err := Float(material["Percent"])
-					if err == nil {
-						materialJson["share"] = share
-					}
-					materialsJson[i] = materialJson
-				}
-				body["materials"] = materialsJson
-			default:
-				log.Print("Unhandled materials type ", v, "; event is ", event)
+		var ids []int64
+		var messages []string
+		for rows.Next() {
+			var id int64
+			var message string
+			err = rows.Scan(&id, &message)
+			if err != nil {
+				logging.Error("Failed to read rejected message", logging.Fields{"error": err})
+				continue
 			}
+			ids = append(ids, id)
+			messages = append(messages, message)
 		}
-		body["name"] = bodyname
-		// Orbital inclination
-		inclination, err := Float(event["OrbitalInclination"])
-		if err == nil {
-			body["orbital_inclination"] = inclination
-		}
-		// Orbital period
-		orbitalPeriod, err := Float(event["OrbitalPeriod"])
-		if err == nil {
-			body["orbital_period"] = orbitalPeriod
-		}
-		// Radius
-		radius, err := Float(event["Radius"])
-		if err == nil {
-			body["radius"] = radius / 1000
-		}
-		// Rotational period
-		rotationalPeriod, err := Float(event["RotationPeriod"])
-		if err == nil {
-			body["rotational_period"] = rotationalPeriod / 86400
-		}
-		// Semi-major axis
-		semiMajorAxis, err := Float(event["SemiMajorAxis"])
-		if err == nil {
-			body["semi_major_axis"] = semiMajorAxis / 149597870700
-		}
-		// Surface pressure
-		pressure, err := Float(event["SurfacePressure"])
-		if err == nil {
-			body["surface_pressure"] = pressure / 101325
+		rows.Close()
+		if len(ids) == 0 {
+			break
 		}
-		// Surface temperature
-		surfaceTemperature, err := Float(event["SurfaceTemperature"])
-		if err == nil {
-			body["surface_temperature"] = surfaceTemperature
-		}
-		// Terraforming state
-		terraformState := event["TerraformState"]
-		if terraformState == "" {
-			body["terraforming_state_id"] = 1
-			body["terraforming_state_name"] = "Not terraformable"
-		} else if terraformState == "Terraformable" {
-			body["terraforming_state_id"] = 2
-			body["terraforming_state_name"] = "Candidate for terraforming"
-		} else if terraformState == "Terraforming" {
-			body["terraforming_state_id"] = 3
-			body["terraforming_state_name"] = "Terraforming completed"
-		} else if terraformState == "Terraformed" {
-			body["terraforming_state_id"] = 4
-			body["terraforming_state_name"] = "Being terraformed"
-		}
-		// Type
-		planetClass := event["PlanetClass"]
-		if planetClass == "Sudarsky class I gas giant" {
-			body["type_id"] = 21
-			body["type"] = "Class I gas giant"
-		} else if planetClass == "Sudarsky class II gas giant" {
-			body["type_id"] = 22
-			body["type"] = "Class II gas giant"
-		} else if planetClass == "Sudarsky class III gas giant" {
-			body["type_id"] = 23
-			body["type"] = "Class III gas giant"
-		} else if planetClass == "Sudarsky class IV gas giant" {
-			body["type_id"] = 24
-			body["type"] = "Class IV gas giant"
-		} else if planetClass == "Sudarsky class V gas giant" {
-			body["type_id"] = 25
-			body["type"] = "Class V gas giant"
-		} else if planetClass == "Earthlike body" {
-			body["type_id"] = 26
-			body["type"] = "Earth-like world"
-		} else if planetClass == "Gas giant with ammonia based life" {
-			body["type_id"] = 27
-			body["type"] = "Gas giant with ammonia-based life"
-		} else if planetClass == "Gas giant with water based life" {
-			body["type_id"] = 28
-			body["type"] = "Gas giant with water-based life"
-		} else if planetClass == "Helium rich gas giant" {
-			body["type_id"] = 29
-			body["type"] = "Helium-rich gas giant"
-		} else if planetClass == "High metal content body" {
-			body["type_id"] = 30
-			body["type"] = "High metal content world"
-		} else if planetClass == "Icy body" {
-			body["type_id"] = 31
-			body["type"] = "Icy body"
-		} else if planetClass == "Metal rich body" {
-			body["type_id"] = 32
-			body["type"] = "Metal-rich body"
-		} else if planetClass == "Rocky body" {
-			body["type_id"] = 33
-			body["type"] = "Rocky body"
-		} else if planetClass == "Rocky ice body" {
-			body["type_id"] = 34
-			body["type"] = "Rocky ice world"
-		} else if planetClass == "Water giant" {
-			body["type_id"] = 35
-			body["type"] = "Water giant"
-		} else if planetClass == "Water world" {
-			body["type_id"] = 36
-			body["type"] = "Water world"
-		}
-		if event["Volcanism"] != nil && event["Volcanism"] != "" && event["Volcanism"] != "No volcanism" {
-			volcanism := event["Volcanism"].(string)
-			volcanismJson := make(map[string]interface{})
-			volcanism = strings.Replace(volcanism, " volcanism", "", 1)
-			// Volcanism type
-			if strings.HasSuffix(volcanism, " geysers") {
-				volcanism = strings.Replace(volcanism, " geysers", "", 1)
-				volcanismJson["type"] = "Geysers"
-			} else if strings.HasSuffix(volcanism, " magma") {
-				volcanism = strings.Replace(volcanism, " magma", "", 1)
-				volcanismJson["type"] = "Magma"
+
+		for i := range ids {
+			// There is no publisher, as subscribers aren't interested in old changes
+			rejection := HandleMessage(bytes.NewBufferString(messages[i]), nil)
+			if rejection == nil {
+				handled++
+				_, err = deadLetterDb.Exec("DELETE FROM rejected WHERE id = ?", ids[i])
+			} else {
+				rejected++
+				_, err = deadLetterDb.Exec("UPDATE rejected SET reason = ?, error = ? WHERE id = ?", rejection.Reason, rejection.Err.Error(), ids[i])
 			}
-			// Volcanism amount
-			if strings.HasPrefix(volcanism, "major") {
-				volcanism = strings.Replace(volcanism, "major ", "", 1)
-				volcanismJson["amount"] = "Major"
-			} else if strings.HasPrefix(volcanism, "minor") {
-				volcanism = strings.Replace(volcanism, "minor ", "", 1)
-				volcanismJson["amount"] = "Minor"
+			if err != nil {
+				logging.Error("Failed to update rejected message", logging.Fields{"id": ids[i], "error": err})
 			}
-			// Volcanism composition
-			volcanismJson["composition"] = TranslateVolcanism(volcanism)
-			body["volcanism"] = volcanismJson
 		}
+		lastId = ids[len(ids)-1]
+	}
+	logging.Info("Reprocessed messages", logging.Fields{"messages": handled + rejected, "handled": handled, "rejected": rejected})
+}
 
-		// Create or update
-		bodystr, err := json.Marshal(body)
-		if errFound(err, raw) {
-			return
+// Replay runs archived messages through HandleMessage, in order.  Archives can be gzipped
+// (as written by the listener) or plain JSONL.  If realtime is set then messages are spaced
+// out according to the times that the EDDN gateway originally received them.  If since is set
+// then messages that the gateway received before then are skipped
+func Replay(filenames []string, realtime bool, since time.Time) {
+	var handled, rejected int
+	var lastReceived time.Time
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil {
+			logging.Error("Failed to open archive", logging.Fields{"file": filename, "error": err})
+			continue
 		}
 
-		if exists {
-			bodyId, err := Int(body["id"])
-			if errFound(err, raw) {
-				return
+		var reader io.Reader = file
+		if strings.HasSuffix(filename, ".gz") {
+			gzipReader, err := gzip.NewReader(file)
+			if err != nil {
+				logging.Error("Failed to open archive", logging.Fields{"file": filename, "error": err})
+				file.Close()
+				continue
 			}
-			err = UpdateBody(bodyId, string(bodystr))
-			if errFound(err, raw) {
-				return
+			reader = gzipReader
+		}
+
+		scanner := bufio.NewScanner(reader)
+		// Market messages can be large
+		scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for scanner.Scan() {
+			msg := bytes.NewBuffer(append([]byte(nil), scanner.Bytes()...))
+			if realtime || !since.IsZero() {
+				envelope, err := eddn.DecodeEnvelope(msg.Bytes())
+				if err == nil {
+					received, err := eddn.ParseTimestamp(envelope.Header.GatewayTimestamp)
+					if err == nil {
+						if received.Before(since) {
+							continue
+						}
+						if realtime {
+							if !lastReceived.IsZero() && received.After(lastReceived) {
+								time.Sleep(received.Sub(lastReceived))
+							}
+							lastReceived = received
+						}
+					}
+				}
 			}
-		} else {
-			err = InsertBody(systemId, bodyname, string(bodystr))
-			if errFound(err, raw) {
-				return
+
+			// There is no publisher, as subscribers aren't interested in old changes.  Rejected
+			// messages are kept, as the workers keep them
+			rejection := HandleMessage(msg, nil)
+			if rejection == nil {
+				handled++
+			} else {
+				rejected++
+				StoreRejection(msg.String(), rejection)
 			}
+			atomic.StoreInt64(&lastHandled, time.Now().UnixNano())
+		}
+		// The current hour's archive is still being written, and those of a run that crashed were
+		// left, so either can end part way through a stream
+		if scanner.Err() != nil && scanner.Err() != io.ErrUnexpectedEOF {
+			logging.Error("Failed to read archive", logging.Fields{"file": filename, "error": scanner.Err()})
 		}
+		file.Close()
 	}
-
-	log.Print(bodyname, "@", systemname, " body scanned")
+	logging.Info("Replayed messages", logging.Fields{"messages": handled + rejected, "handled": handled, "rejected": rejected})
 }
 
-func HandleStarScanEvent(raw string, event map[string]interface{}, publisher *zmq.Socket) {
-	systemname := event["StarSystem"].(string)
-	bodyname := event["BodyName"].(string)
+// Archive appends messages to hourly gzipped JSONL files, suitable for Replay.  Each run of the
+// listener has files of its own, as a file left by one that crashed ends part way through a
+// gzip stream, and anything appended after that could not be read
+type Archive struct {
+	mutex     sync.Mutex
+	dir       string
+	started   string
+	hour      string
+	file      *os.File
+	writer    *gzip.Writer
+	lastFlush time.Time
+}
 
-	// Fetch the current system from the database
-	systemx, err := Float(event["StarPos"].([]interface{})[0])
-	assertNil(err)
-	systemx = fixCoord(systemx)
-	systemy, err := Float(event["StarPos"].([]interface{})[1])
-	assertNil(err)
-	systemy = fixCoord(systemy)
-	systemz, err := Float(event["StarPos"].([]interface{})[2])
-	assertNil(err)
-	systemz = fixCoord(systemz)
+func NewArchive(dir string) *Archive {
+	return &Archive{dir: dir, started: strconv.FormatInt(time.Now().UnixNano(), 10)}
+}
 
-	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
-	if err != nil {
-		// System doesn't exist - ignore
-	} else {
-		// Turn the system in to JSON
-		d := json.NewDecoder(strings.NewReader(systemdata))
-		d.UseNumber()
-		var system map[string]interface{}
-		err = d.Decode(&system)
-		if errFound(err, raw) {
-			return
+// Write archives a single message, to eddn-<hour>-<started>.jsonl.gz.  Should this run come
+// back to a file that it closed, appending adds a new gzip member, which readers handle
+// transparently
+func (a *Archive) Write(msg []byte) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now().UTC()
+	hour := now.Format("2006-01-02T15")
+	if hour != a.hour {
+		err := a.close()
+		if err != nil {
+			logging.Error("Failed to close archive", logging.Fields{"error": err})
 		}
-
-		// Now fetch the body
-		systemId, err := Int(system["id"])
-		if errFound(err, raw) {
-			return
+		err = os.MkdirAll(a.dir, 0755)
+		if err != nil {
+			return err
 		}
-		body, err := FetchBody(systemId, bodyname)
-		var exists bool
+		a.file, err = os.OpenFile(filepath.Join(a.dir, "eddn-"+hour+"-"+a.started+".jsonl.gz"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
-			exists = false
-			body = make(map[string]interface{})
-			body["created_at"] = int32(time.Now().Unix())
-		} else {
-			exists = true
+			return err
 		}
+		a.writer = gzip.NewWriter(a.file)
+		a.hour = hour
+		a.lastFlush = now
+	}
 
-		body["updated_at"] = int32(time.Now().Unix())
+	// One message per line
+	var line bytes.Buffer
+	err := json.Compact(&line, msg)
+	if err != nil {
+		// Keep it anyway, so that replays see exactly what we saw
+		line.Reset()
+		line.Write(bytes.Replace(msg, []byte("\n"), []byte(" "), -1))
+	}
+	line.WriteByte('\n')
+	_, err = a.writer.Write(line.Bytes())
+	if err != nil {
+		return err
+	}
 
-		// Age
-		age, err := Int(event["Age_MY"])
-		if err == nil {
-			body["age"] = age
-		}
-		// Periapsis
-		periapsis, err := Float(event["Periapsis"])
-		if err == nil {
-			body["arg_of_periapsis"] = periapsis
-		}
-		// Distance
-		distance, err := Float(event["DistanceFromArrivalLS"])
-		if err == nil {
-			body["distance_to_arrival"] = distance
-		}
-		body["group_id"] = 2
-		body["group_name"] = "Star"
-		body["is_landable"] = 0
-		if distance == 0 {
-			body["is_main_star"] = true
-		} else {
-			body["is_main_star"] = false
-		}
-		body["is_rotational_period_tidally_locked"] = false
-		body["name"] = bodyname
-		// Orbital eccentricity
-		eccentricity, err := Float(event["Eccentricity"])
-		if err == nil {
-			body["orbital_eccentricity"] = eccentricity
-		}
-		// Orbital inclination
-		inclination, err := Float(event["OrbitalInclination"])
-		if err == nil {
-			body["orbital_inclination"] = inclination
-		}
-		// Orbital period
-		orbitalPeriod, err := Float(event["OrbitalPeriod"])
-		if err == nil {
-			body["orbital_period"] = orbitalPeriod
-		}
-		// Rotational period
-		rotationalPeriod, err := Float(event["RotationPeriod"])
-		if err == nil {
-			body["rotational_period"] = rotationalPeriod / 86400
-		}
-		// Semi-major axis
-		semiMajorAxis, err := Float(event["SemiMajorAxis"])
-		if err == nil {
-			body["semi_major_axis"] = semiMajorAxis / 149597870700
-		}
-		// Stellar mass
-		stellarMass, err := Float(event["StellarMass"])
-		if err == nil {
-			body["solar_masses"] = stellarMass
-		}
-		// Radius
-		radius, err := Float(event["Radius"])
-		if err == nil {
-			body["solar_radius"] = radius / 695700000
-		}
-		// Stellar class
-		body["spectral_class"] = event["StarType"]
-		// Surface temperature
-		surfaceTemperature, err := Float(event["SurfaceTemperature"])
-		if err == nil {
-			body["surface_temperature"] = surfaceTemperature
-		}
-
-		// Update body data
-		// d := json.NewDecoder(strings.NewReader(systemdata))
-		// d.UseNumber()
-		// var body map[string]interface{}
-		// err = d.Decode(&body)
-		// if errFound(err, raw) {
-		// return
-		// }
-		// Create or update
-		bodystr, err := json.Marshal(body)
-		if errFound(err, raw) {
-			return
-		}
+	// Flushing reduces compression, so only do it every so often
+	if now.Sub(a.lastFlush) > 10*time.Second {
+		a.lastFlush = now
+		return a.writer.Flush()
+	}
+	return nil
+}
 
-		if exists {
-			bodyId, err := Int(body["id"])
-			if errFound(err, raw) {
-				return
-			}
-			err = UpdateBody(bodyId, string(bodystr))
-			if errFound(err, raw) {
-				return
-			}
-		} else {
-			err = InsertBody(systemId, bodyname, string(bodystr))
-			if errFound(err, raw) {
-				return
-			}
-		}
-		log.Print(bodyname, "@", systemname, " star scanned")
+// Flush writes out any messages that are buffered, so that they can be replayed
+func (a *Archive) Flush() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.writer == nil {
+		return nil
 	}
+	a.lastFlush = time.Now().UTC()
+	return a.writer.Flush()
 }
 
-func HandleDockedEvent(raw string, event map[string]interface{}, publisher *zmq.Socket) {
-	systemname := event["StarSystem"].(string)
-	stationname := event["StationName"].(string)
+func (a *Archive) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.close()
+}
 
-	stationfaction := event["StationFaction"]
-	if stationfaction == nil {
-		stationfaction = ""
+func (a *Archive) close() error {
+	if a.writer == nil {
+		return nil
 	}
-
-	// For 'Docked' events a missing allegiance implies Independent
-	stationallegiance := event["StationAllegiance"]
-	if stationallegiance == nil {
-		stationallegiance = "Faction_Independent"
+	err := a.writer.Close()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
 	}
-	stationallegiance = TranslateAllegiance(stationallegiance.(string))
+	a.writer = nil
+	a.file = nil
+	a.hour = ""
+	return err
+}
 
-	stationeconomy := event["StationEconomy"]
-	if stationeconomy == nil {
-		stationeconomy = ""
+// HandlerLoop decompresses messages and hands them to a fixed pool of workers.  Messages for
+// the same system always go to the same worker, so they are applied in the order received.
+// It signals doneChannel once msgChannel is closed and all messages have been handled
+func HandlerLoop(publisher *zmq.Socket, msgChannel chan [][]byte, doneChannel chan bool) {
+	var workers sync.WaitGroup
+	workerChannels := make([]chan *bytes.Buffer, cfg.EDDN.Workers)
+	for i := range workerChannels {
+		workerChannels[i] = make(chan *bytes.Buffer, cfg.EDDN.QueueSize)
+		workers.Add(1)
+		go func(workerChannel chan *bytes.Buffer) {
+			defer workers.Done()
+			for msg := range workerChannel {
+				handlingMutex.RLock()
+				rejection := HandleMessage(msg, publisher)
+				if rejection != nil {
+					StoreRejection(msg.String(), rejection)
+				}
+				handlingMutex.RUnlock()
+				atomic.StoreInt64(&lastHandled, time.Now().UnixNano())
+			}
+		}(workerChannels[i])
 	}
-	stationeconomy = TranslateEconomy(stationeconomy.(string))
 
-	stationgovernment := event["StationGovernment"]
-	if stationgovernment == nil {
-		stationgovernment = ""
+	archive := messageArchive
+	for raw := range msgChannel {
+		var msg bytes.Buffer
+		r, err := zlib.NewReader(bytes.NewReader(raw[0]))
+		if errFound(err, "Failed to decompress message") {
+			continue
+		}
+		_, err = io.Copy(&msg, r)
+		r.Close()
+		if errFound(err, "Failed to decompress message") {
+			continue
+		}
+
+		if archive != nil {
+			err = archive.Write(msg.Bytes())
+			if err != nil {
+				logging.Error("Failed to archive message", logging.Fields{"error": err})
+			}
+		}
+
+		hash := fnv.New32a()
+		hash.Write([]byte(MessageSystem(msg.Bytes())))
+		workerChannels[hash.Sum32()%uint32(len(workerChannels))] <- &msg
 	}
-	stationgovernment = TranslateGovernment(stationgovernment.(string))
 
-	stationstate := event["FactionState"]
-	if stationstate == nil {
-		stationstate = ""
+	if archive != nil {
+		err := archive.Close()
+		if err != nil {
+			logging.Error("Failed to close archive", logging.Fields{"error": err})
+		}
 	}
-	stationstate = TranslateState(stationstate.(string))
 
-	// Fetch the current system from the database
-	systemx, err := Float(event["StarPos"].([]interface{})[0])
-	assertNil(err)
-	systemx = fixCoord(systemx)
-	systemy, err := Float(event["StarPos"].([]interface{})[1])
-	assertNil(err)
-	systemy = fixCoord(systemy)
-	systemz, err := Float(event["StarPos"].([]interface{})[2])
-	assertNil(err)
-	systemz = fixCoord(systemz)
+	for i := range workerChannels {
+		close(workerChannels[i])
+	}
+	workers.Wait()
+	doneChannel <- true
+}
 
-	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
+// MessageSystem obtains the name of the system that a message is about, for the purpose of
+// ordering messages.  Messages without a single system are all treated as being about ""
+func MessageSystem(msg []byte) string {
+	var data struct {
+		Message struct {
+			StarSystem       string `json:"StarSystem"`
+			SystemName       string `json:"SystemName"`
+			System           string `json:"System"`
+			LegacySystemName string `json:"systemName"`
+		} `json:"message"`
+	}
+	err := json.Unmarshal(msg, &data)
 	if err != nil {
-		// System doesn't exist - make it
-	} else {
-		// Turn the system in to JSON
-		d := json.NewDecoder(strings.NewReader(systemdata))
-		d.UseNumber()
-		var system map[string]interface{}
-		err = d.Decode(&system)
-		if errFound(err, raw) {
-			return
+		return ""
+	}
+	for _, name := range []string{data.Message.StarSystem, data.Message.SystemName, data.Message.System, data.Message.LegacySystemName} {
+		if name != "" {
+			// System names are case-insensitive in the database
+			return strings.ToLower(name)
 		}
+	}
+	return ""
+}
 
-		// Only if the event's timestamp is after the last time we updated the data
-		eventTime, err := time.Parse(time.RFC3339, event["timestamp"].(string))
-		if errFound(err, raw) {
-			return
+// Publish sends a notification to our subscribers.  ZeroMQ sockets are not safe for
+// concurrent use, so the workers take turns
+func Publish(publisher *zmq.Socket, topic string, msg string) {
+	if publisher == nil {
+		return
+	}
+	publisherMutex.Lock()
+	defer publisherMutex.Unlock()
+	_, err := publisher.SendMessage(topic, msg)
+	if err != nil {
+		logging.Error("Failed to publish", logging.Fields{"topic": topic, "error": err})
+	}
+}
+
+// Reasons for rejecting a message
+const (
+	RejectInvalidEnvelope = "invalid_envelope"
+	RejectInvalidMessage  = "invalid_message"
+	RejectBadTimestamp    = "bad_timestamp"
+	RejectDatabase        = "database_error"
+	RejectPanic           = "panic"
+)
+
+// Rejection records why we could not handle a message, and where the message came from
+type Rejection struct {
+	Reason          string
+	Err             error
+	Schema          string
+	SoftwareName    string
+	SoftwareVersion string
+}
+
+func (r *Rejection) Error() string {
+	return r.Reason + ": " + r.Err.Error()
+}
+
+// HandleMessage decodes a message and passes it to the relevant handler.  Messages that we
+// cannot handle are logged along with the reason, and that reason is returned
+func HandleMessage(msg *bytes.Buffer, publisher *zmq.Socket) *Rejection {
+	envelope, err := eddn.DecodeEnvelope(msg.Bytes())
+	if err != nil {
+		rejection := &Rejection{Reason: RejectInvalidEnvelope, Err: err}
+		RecordRejection(msg.String(), rejection)
+		return rejection
+	}
+
+	messagesReceived.WithLabelValues(envelope.SchemaLabel(), envelope.SoftwareLabel()).Inc()
+
+	// Check to see if it is interesting to us and not blocked
+	if !ClientAllowed(envelope.Header, envelope.SchemaRef) {
+		messageOutcomes.WithLabelValues("blocked").Inc()
+		return nil
+	}
+	if !GalaxyAllowed(envelope) {
+		messageOutcomes.WithLabelValues(envelope.Galaxy()).Inc()
+		return nil
+	}
+
+	// The same event is often uploaded by several tools.  A message that cannot be keyed is
+	// left for DispatchMessage to reject
+	key, keyErr := envelope.DedupKey()
+	if keyErr == nil && dedupCache.Seen(key) {
+		messageOutcomes.WithLabelValues("duplicate").Inc()
+		return nil
+	}
+
+	start := time.Now()
+	rejection := DispatchMessage(envelope, publisher)
+	handlerSeconds.WithLabelValues(envelope.SchemaLabel()).Observe(time.Since(start).Seconds())
+	if rejection != nil {
+		rejection.Schema = envelope.SchemaRef
+		rejection.SoftwareName = envelope.Header.SoftwareName
+		rejection.SoftwareVersion = envelope.Header.SoftwareVersion
+		RecordRejection(msg.String(), rejection)
+		return rejection
+	}
+	messageOutcomes.WithLabelValues("accepted").Inc()
+	if keyErr == nil {
+		dedupCache.Add(key)
+	}
+	return nil
+}
+
+// DispatchMessage decodes the message according to its schema and passes it to the relevant
+// handler.  Any failure, including a panic within the handler, results in a rejection
+func DispatchMessage(envelope *eddn.Envelope, publisher *zmq.Socket) (rejection *Rejection) {
+	defer func() {
+		if r := recover(); r != nil {
+			rejection = &Rejection{Reason: RejectPanic, Err: fmt.Errorf("%v\n%s", r, debug.Stack())}
 		}
-		updateTime := IntOr(system["updated_at"], 0)
-		if eventTime.Unix() > updateTime {
-			systemId, err := Int(system["id"])
-			if errFound(err, raw) {
-				return
+	}()
+
+	var handler func() error
+	var err error
+	switch envelope.SchemaRef {
+	case eddn.JournalSchema:
+		var event eddn.JournalEvent
+		err = envelope.Decode(&event)
+		if err != nil {
+			break
+		}
+		switch event.Event {
+		case "FSDJump":
+			var fsdJump eddn.FSDJumpEvent
+			err = envelope.Decode(&fsdJump)
+			handler = func() error { return HandleFSDJumpEvent(&fsdJump, publisher) }
+		case "Docked":
+			var docked eddn.DockedEvent
+			err = envelope.Decode(&docked)
+			handler = func() error { return HandleDockedEvent(&docked, publisher) }
+		case "FSSDiscoveryScan", "FSSAllBodiesFound", "NavBeaconScan":
+			var bodyCount eddn.BodyCountEvent
+			err = envelope.Decode(&bodyCount)
+			handler = func() error { return HandleBodyCountEvent(&bodyCount, publisher) }
+		case "Scan":
+			var scan eddn.ScanEvent
+			err = envelope.Decode(&scan)
+			if scan.StellarMass == nil {
+				handler = func() error { return HandleBodyScanEvent(&scan, publisher) }
+			} else {
+				handler = func() error { return HandleStarScanEvent(&scan, publisher) }
 			}
+		}
+	case eddn.FSSDiscoveryScanSchema, eddn.FSSAllBodiesFoundSchema, eddn.NavBeaconScanSchema:
+		var bodyCount eddn.BodyCountEvent
+		err = envelope.Decode(&bodyCount)
+		handler = func() error { return HandleBodyCountEvent(&bodyCount, publisher) }
+	case eddn.NavRouteSchema:
+		var navRoute eddn.NavRouteMessage
+		err = envelope.Decode(&navRoute)
+		handler = func() error { return HandleNavRouteSchema(&navRoute, publisher) }
+	case eddn.CodexEntrySchema:
+		var codexEntry eddn.CodexEntryMessage
+		err = envelope.Decode(&codexEntry)
+		handler = func() error { return HandleCodexEntrySchema(&codexEntry, publisher) }
+	case eddn.ApproachSettlementSchema:
+		var approachSettlement eddn.ApproachSettlementMessage
+		err = envelope.Decode(&approachSettlement)
+		handler = func() error { return HandleApproachSettlementSchema(&approachSettlement, publisher) }
+	case eddn.CommoditySchema:
+		var commodity eddn.CommodityMessage
+		err = envelope.Decode(&commodity)
+		handler = func() error { return HandleCommodity3Schema(&commodity, publisher) }
+	case eddn.OutfittingSchema:
+		var outfitting eddn.OutfittingMessage
+		err = envelope.Decode(&outfitting)
+		handler = func() error { return HandleOutfitting2Schema(&outfitting, publisher) }
+	}
+	if _, ok := err.(*eddn.TimestampError); ok {
+		return &Rejection{Reason: RejectBadTimestamp, Err: err}
+	}
+	if err != nil {
+		return &Rejection{Reason: RejectInvalidMessage, Err: err}
+	}
+	if handler == nil {
+		// Not something that we are interested in
+		return nil
+	}
 
-			stationdata, err := FetchStation(systemId, stationname)
-			if err != nil {
-				// Station doesn't exist - create it
-			} else {
-				// Turn the station into JSON
-				d2 := json.NewDecoder(strings.NewReader(stationdata))
-				d2.UseNumber()
-				var station map[string]interface{}
-				err = d2.Decode(&station)
-				if errFound(err, raw) {
-					return
-				}
+	// Once a message is validated the only thing that can go wrong is the database
+	err = handler()
+	if err != nil {
+		dbWriteErrors.Inc()
+		return &Rejection{Reason: RejectDatabase, Err: err}
+	}
+	atomic.StoreInt64(&lastWritten, time.Now().UnixNano())
+	return nil
+}
 
-				var update map[string]interface{}
-				update = make(map[string]interface{})
+// RecordRejection logs a message that we could not handle
+func RecordRejection(raw string, rejection *Rejection) {
+	messageOutcomes.WithLabelValues("rejected").Inc()
+	messagesRejected.WithLabelValues(rejection.Reason).Inc()
+	logging.Warn("Rejected message", logging.Fields{
+		"schema":           rejection.Schema,
+		"software":         rejection.SoftwareName,
+		"software_version": rejection.SoftwareVersion,
+		"reason":           rejection.Reason,
+		"error":            rejection.Err,
+		"message":          raw,
+	})
+}
 
-				updaterequired := false
+func ClientAllowed(header eddn.Header, schema string) bool {
+	return blocklist.Blocked(header.SoftwareName, header.SoftwareVersion, schema) == nil
+}
 
-				dballegiance := JsonString(station["allegiance"])
-				if dballegiance != stationallegiance {
-					updaterequired = true
-					log.Print(stationname, "@", system["name"], " station allegiance ", dballegiance, " -> ", stationallegiance)
-					if dballegiance != "" {
-						update["oldallegiance"] = dballegiance
-						update["newallegiance"] = stationallegiance
-					}
-				}
+// GalaxyAllowed checks that a message comes from the live galaxy, counting the decision
+func GalaxyAllowed(envelope *eddn.Envelope) bool {
+	galaxy := envelope.Galaxy()
+	for _, filter := range galaxyFilters {
+		if filter.Galaxy == galaxy {
+			atomic.AddUint64(&filter.Messages, 1)
+			return filter.Decision == "accepted"
+		}
+	}
+	return false
+}
 
-				dbeconomy := JsonString(station["primary_economy"])
-				if dbeconomy != stationeconomy {
-					updaterequired = true
-					log.Print(stationname, "@", system["name"], " station economy ", dbeconomy, " -> ", stationeconomy)
-					if dbeconomy != "" {
-						update["oldeconomy"] = dbeconomy
-						update["neweconomy"] = stationeconomy
-					}
-				}
+// AdminServer provides information about the listener over HTTP
+func AdminServer() {
+	admin := http.NewServeMux()
+	admin.HandleFunc("/blocklist", BlocklistHandler)
+	admin.HandleFunc("/galaxies", GalaxiesHandler)
+	admin.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	admin.HandleFunc("/status", StatusHandler)
+	admin.HandleFunc("/health", StatusHandler)
+	admin.HandleFunc("/swap", SwapHandler)
+	err := http.ListenAndServe(cfg.EDDN.AdminAddr, admin)
+	if err != nil {
+		logging.Error("Admin server failed", logging.Fields{"addr": cfg.EDDN.AdminAddr, "error": err})
+	}
+}
 
-				dbgovernment := JsonString(station["government"])
-				if dbgovernment != stationgovernment {
-					updaterequired = true
-					log.Print(stationname, "@", system["name"], " station government ", dbgovernment, " -> ", stationstate)
-					if dbgovernment != "" {
-						update["oldgovernment"] = dbgovernment
-						update["newgovernment"] = stationgovernment
-					}
-				}
+// BlocklistHandler shows the active blocklist rules along with the number of messages each has dropped
+func BlocklistHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := json.Marshal(blocklist.Rules())
+	if err != nil {
+		logging.Error("Failed to encode blocklist", logging.Fields{"error": err})
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rules)
+}
 
-				dbfaction := JsonString(station["controlling_faction"])
-				if dbfaction != stationfaction {
-					updaterequired = true
-					log.Print(stationname, "@", system["name"], " station controllling faction ", dbfaction, " -> ", stationfaction)
-					if dbfaction != "" {
-						update["oldfaction"] = dbfaction
-						update["newfaction"] = stationfaction
-					}
-				}
+// ListenerStatus describes what the listener is up to
+type ListenerStatus struct {
+	Healthy       bool       `json:"healthy"`
+	Problem       string     `json:"problem,omitempty"`
+	LastReceived  *time.Time `json:"last_received"`
+	OutageSince   *time.Time `json:"outage_since,omitempty"`
+	QueueDepth    int        `json:"queue_depth"`
+	QueueCapacity int        `json:"queue_capacity"`
+	LastHandled   *time.Time `json:"last_handled"`
+	LastWritten   *time.Time `json:"last_written"`
+}
 
-				dbstate := JsonString(station["state"])
-				if dbstate != stationstate {
-					updaterequired = true
-					log.Print(stationname, "@", system["name"], " station state ", dbstate, " -> ", stationstate)
-					if dbstate != "" {
-						update["oldstate"] = dbstate
-						update["newstate"] = stationstate
-					}
-				}
+func loadTime(addr *int64) *time.Time {
+	nanos := atomic.LoadInt64(addr)
+	if nanos == 0 {
+		return nil
+	}
+	t := time.Unix(0, nanos).UTC()
+	return &t
+}
 
-				if updaterequired {
-					// Update the database
-					station["allegiance"] = stationallegiance
-					station["primary_economy"] = stationeconomy
-					station["government"] = stationgovernment
-					station["state"] = stationstate
-					station["updated_at"] = int32(time.Now().Unix())
-					station["controlling_faction"] = stationfaction
-					updatedStation, err := json.Marshal(station)
-					if errFound(err, raw) {
-						return
-					}
-					stationId, err := Int(station["id"])
-					if errFound(err, raw) {
-						return
-					}
-					UpdateStation(systemId, stationId, string(updatedStation))
-					if errFound(err, raw) {
-						return
-					}
+// Status reports what the listener is up to.  The listener is unhealthy if messages are waiting
+// but the workers have not handled one within the liveness timeout; an EDDN outage on its own
+// is not our problem, and reconnecting is already taken care of
+func Status() ListenerStatus {
+	status := ListenerStatus{
+		Healthy:       true,
+		LastReceived:  loadTime(&feedLastReceived),
+		OutageSince:   loadTime(&feedOutageStart),
+		QueueDepth:    len(messageQueue),
+		QueueCapacity: cap(messageQueue),
+		LastHandled:   loadTime(&lastHandled),
+		LastWritten:   loadTime(&lastWritten),
+	}
+	timeout := time.Duration(cfg.EDDN.LivenessTimeout) * time.Second
+	if status.QueueDepth > 0 && status.LastHandled != nil && time.Since(*status.LastHandled) > timeout {
+		status.Healthy = false
+		status.Problem = fmt.Sprintf("%d messages queued but none handled in %v", status.QueueDepth, timeout)
+	}
+	return status
+}
 
-					// Send notification
-					update["systemname"] = systemname
-					update["stationname"] = stationname
-					update["x"] = systemx
-					update["y"] = systemy
-					update["z"] = systemz
-					updateJson, err := json.Marshal(update)
-					if errFound(err, raw) {
-						return
-					}
-					_, _ = publisher.SendMessage("eddp.delta.station", string(updateJson))
-				}
+// StatusHandler shows what the listener is up to.  For /health the response is a 503 if the
+// listener is unhealthy
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := Status()
+	data, err := json.Marshal(status)
+	if err != nil {
+		logging.Error("Failed to encode status", logging.Fields{"error": err})
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/health" && !status.Healthy {
+		w.WriteHeader(503)
+	}
+	w.Write(data)
+}
+
+// SwapHandler swaps in the database built by eddp-admin rebuild when POSTed to with the admin
+// token.  Anything that can reach the admin server could otherwise replace the database
+func SwapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	if adminToken == "" {
+		logging.Warn("Refused to swap database without an admin token", logging.Fields{"remote_addr": r.RemoteAddr})
+		w.WriteHeader(403)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+adminToken)) != 1 {
+		logging.Warn("Refused to swap database with a wrong admin token", logging.Fields{"remote_addr": r.RemoteAddr})
+		w.WriteHeader(401)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := SwapDatabase()
+	if err != nil {
+		logging.Error("Failed to swap database", logging.Fields{"error": err})
+		data, _ := json.Marshal(map[string]interface{}{"swapped": false, "error": err.Error()})
+		w.WriteHeader(500)
+		w.Write(data)
+		return
+	}
+	io.WriteString(w, "{\"swapped\":true}")
+}
+
+// SwapDatabase replaces eddp.sqlite with eddp-new.sqlite, keeping the old one as
+// eddp-old.sqlite, and pauses handling while it does so.  The new database only has what we
+// wrote up to the start of the rebuild, so archived messages received since then are replayed
+// on to it.  eddpd notices the new file by itself
+func SwapDatabase() error {
+	if cfg.EDDN.ArchiveDir == "" {
+		return errors.New("eddn.archive_dir must be set, to replay messages received during the rebuild")
+	}
+	liveFile := cfg.DataDir + "/sqlite/eddp.sqlite"
+	newFile := cfg.DataDir + "/sqlite/eddp-new.sqlite"
+	oldFile := cfg.DataDir + "/sqlite/eddp-old.sqlite"
+
+	handlingMutex.Lock()
+	defer handlingMutex.Unlock()
+
+	since, err := RebuildStarted(newFile)
+	if err != nil {
+		return err
+	}
+	logging.Info("Swapping database", logging.Fields{"file": newFile, "rebuild_started": since})
+
+	// Make sure that the new database can be used before it replaces the live one
+	db, err := sql.Open("sqlite3", newFile)
+	if err != nil {
+		return err
+	}
+	err = SetupTables(db)
+	closeErr := db.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The old database is kept as eddp-old.sqlite, which is how it is put back if the swap fails
+	err = os.Remove(oldFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Link(liveFile, oldFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(newFile, liveFile)
+	if err != nil {
+		return err
+	}
+	db, err = sql.Open("sqlite3", liveFile)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		logging.Error("Failed to open swapped in database; putting back the old one", logging.Fields{"error": err})
+		return RestoreDatabase(liveFile, newFile, oldFile, err)
+	}
+	// The old database is still open on what is now eddp-old.sqlite until it is replaced
+	eddpDb.Close()
+	eddpDb = db
+
+	// Messages already handled have to be handled again, this time on the new database
+	err = messageArchive.Flush()
+	if err != nil {
+		logging.Error("Failed to flush archive", logging.Fields{"error": err})
+	}
+	dedupCache = eddn.NewDedupCache(time.Duration(cfg.EDDN.DedupWindow) * time.Second)
+	Replay(ArchivedSince(since), false, since)
+	logging.Info("Swapped database", logging.Fields{"file": liveFile})
+	return nil
+}
+
+// RestoreDatabase undoes a failed swap, moving the new database back to eddp-new.sqlite and the
+// old one back to eddp.sqlite, and returns the error that caused it along with any of its own
+func RestoreDatabase(liveFile string, newFile string, oldFile string, cause error) error {
+	err := os.Rename(liveFile, newFile)
+	if err != nil {
+		return fmt.Errorf("%v; failed to move back new database: %v", cause, err)
+	}
+	err = os.Rename(oldFile, liveFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%v; failed to restore old database: %v", cause, err)
+	}
+	return cause
+}
+
+// RebuildStarted reads when eddp-admin rebuild started to build a database, checking that it finished
+func RebuildStarted(filename string) (time.Time, error) {
+	// Opening a database that isn't there would create it
+	_, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	var startedAt int64
+	var finishedAt sql.NullInt64
+	err = db.QueryRow("SELECT started_at, finished_at FROM build_info").Scan(&startedAt, &finishedAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s was not built by eddp-admin rebuild: %v", filename, err)
+	}
+	if !finishedAt.Valid {
+		return time.Time{}, fmt.Errorf("%s is still being built", filename)
+	}
+	return time.Unix(startedAt, 0).UTC(), nil
+}
+
+// ArchivedSince lists the archive files that may hold messages received since the given time
+func ArchivedSince(since time.Time) []string {
+	filenames, err := filepath.Glob(filepath.Join(cfg.EDDN.ArchiveDir, "eddn-*.jsonl.gz"))
+	if err != nil {
+		logging.Error("Failed to list archive", logging.Fields{"dir": cfg.EDDN.ArchiveDir, "error": err})
+		return nil
+	}
+	// Every run's files for an hour start with the hour, and sort by when the run started
+	first := "eddn-" + since.UTC().Format("2006-01-02T15")
+	var recent []string
+	for _, filename := range filenames {
+		if filepath.Base(filename) >= first {
+			recent = append(recent, filename)
+		}
+	}
+	return recent
+}
+
+// NotifySystemd sends a state change to systemd, if it started us with a notify socket
+func NotifySystemd(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		logging.Warn("Failed to notify systemd", logging.Fields{"error": err})
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		logging.Warn("Failed to notify systemd", logging.Fields{"error": err})
+	}
+}
+
+// Watchdog keeps systemd's watchdog happy for as long as we are healthy, so that systemd
+// restarts a wedged listener
+func Watchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+		status := Status()
+		if status.Healthy {
+			NotifySystemd("WATCHDOG=1")
+		} else {
+			logging.Warn("Unhealthy", logging.Fields{"problem": status.Problem})
+		}
+	}
+}
+
+// GalaxiesHandler shows what is done with messages from each galaxy and how many there have been
+func GalaxiesHandler(w http.ResponseWriter, r *http.Request) {
+	filters := make([]GalaxyFilter, len(galaxyFilters))
+	for i, filter := range galaxyFilters {
+		filters[i] = GalaxyFilter{
+			Galaxy:   filter.Galaxy,
+			Decision: filter.Decision,
+			Messages: atomic.LoadUint64(&filter.Messages),
+		}
+	}
+	data, err := json.Marshal(filters)
+	if err != nil {
+		logging.Error("Failed to encode galaxy filters", logging.Fields{"error": err})
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func HandleBodyScanEvent(event *eddn.ScanEvent, publisher *zmq.Socket) error {
+	systemname := event.StarSystem
+	bodyname := event.BodyName
+
+	// Fetch the current system from the database
+	systemx, systemy, systemz := fixCoords(event.StarPos)
+	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
+	if err != nil {
+		// System doesn't exist - ignore
+		return nil
+	}
+
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
+
+	// Now fetch the body
+	systemId, err := Int(system["id"])
+	if err != nil {
+		return err
+	}
+	body, err := FetchBody(systemId, bodyname)
+	var exists bool
+	if err != nil {
+		exists = false
+		body = make(map[string]interface{})
+		body["created_at"] = int32(time.Now().Unix())
+	} else {
+		exists = true
+	}
+
+	body["updated_at"] = int32(time.Now().Unix())
+
+	// Periapsis
+	if event.Periapsis != nil {
+		body["arg_of_periapsis"] = *event.Periapsis
+	}
+	// Distance
+	if event.DistanceFromArrivalLS != nil {
+		body["distance_to_arrival"] = *event.DistanceFromArrivalLS
+	}
+	// Eccentricity
+	if event.Eccentricity != nil {
+		body["orbital_eccentricity"] = *event.Eccentricity
+	}
+	// Mass
+	if event.MassEM != nil {
+		body["earth_masses"] = *event.MassEM
+	}
+	// Gravity
+	if event.Gravity != nil {
+		body["gravity"] = *event.Gravity / 9.80665
+	}
+	body["group_id"] = 6
+	body["group_name"] = "Planet"
+	body["is_landable"] = event.Landable
+	body["is_rotational_period_tidally_locked"] = event.TidalLock
+	// Materials
+	if len(event.Materials) > 0 {
+		// Build materials
+		var materialsJson []map[string]interface{}
+		materialsJson = make([]map[string]interface{}, len(event.Materials))
+		// transform each
+		for i, material := range event.Materials {
+			var materialJson map[string]interface{}
+			materialJson = make(map[string]interface{})
+			materialJson["material_name"] = TranslateMaterial(material.Name)
+			materialJson["share"] = material.Percent
+			materialsJson[i] = materialJson
+		}
+		body["materials"] = materialsJson
+	}
+	body["name"] = bodyname
+	// Orbital inclination
+	if event.OrbitalInclination != nil {
+		body["orbital_inclination"] = *event.OrbitalInclination
+	}
+	// Orbital period
+	if event.OrbitalPeriod != nil {
+		body["orbital_period"] = *event.OrbitalPeriod
+	}
+	// Radius
+	if event.Radius != nil {
+		body["radius"] = *event.Radius / 1000
+	}
+	// Rotational period
+	if event.RotationPeriod != nil {
+		body["rotational_period"] = *event.RotationPeriod / 86400
+	}
+	// Semi-major axis
+	if event.SemiMajorAxis != nil {
+		body["semi_major_axis"] = *event.SemiMajorAxis / 149597870700
+	}
+	// Surface pressure
+	if event.SurfacePressure != nil {
+		body["surface_pressure"] = *event.SurfacePressure / 101325
+	}
+	// Surface temperature
+	if event.SurfaceTemperature != nil {
+		body["surface_temperature"] = *event.SurfaceTemperature
+	}
+	// Terraforming state
+	terraformState := event.TerraformState
+	if terraformState == "" {
+		body["terraforming_state_id"] = 1
+		body["terraforming_state_name"] = "Not terraformable"
+	} else if terraformState == "Terraformable" {
+		body["terraforming_state_id"] = 2
+		body["terraforming_state_name"] = "Candidate for terraforming"
+	} else if terraformState == "Terraforming" {
+		body["terraforming_state_id"] = 3
+		body["terraforming_state_name"] = "Terraforming completed"
+	} else if terraformState == "Terraformed" {
+		body["terraforming_state_id"] = 4
+		body["terraforming_state_name"] = "Being terraformed"
+	}
+	// Type
+	planetClass := event.PlanetClass
+	if planetClass == "Sudarsky class I gas giant" {
+		body["type_id"] = 21
+		body["type"] = "Class I gas giant"
+	} else if planetClass == "Sudarsky class II gas giant" {
+		body["type_id"] = 22
+		body["type"] = "Class II gas giant"
+	} else if planetClass == "Sudarsky class III gas giant" {
+		body["type_id"] = 23
+		body["type"] = "Class III gas giant"
+	} else if planetClass == "Sudarsky class IV gas giant" {
+		body["type_id"] = 24
+		body["type"] = "Class IV gas giant"
+	} else if planetClass == "Sudarsky class V gas giant" {
+		body["type_id"] = 25
+		body["type"] = "Class V gas giant"
+	} else if planetClass == "Earthlike body" {
+		body["type_id"] = 26
+		body["type"] = "Earth-like world"
+	} else if planetClass == "Gas giant with ammonia based life" {
+		body["type_id"] = 27
+		body["type"] = "Gas giant with ammonia-based life"
+	} else if planetClass == "Gas giant with water based life" {
+		body["type_id"] = 28
+		body["type"] = "Gas giant with water-based life"
+	} else if planetClass == "Helium rich gas giant" {
+		body["type_id"] = 29
+		body["type"] = "Helium-rich gas giant"
+	} else if planetClass == "High metal content body" {
+		body["type_id"] = 30
+		body["type"] = "High metal content world"
+	} else if planetClass == "Icy body" {
+		body["type_id"] = 31
+		body["type"] = "Icy body"
+	} else if planetClass == "Metal rich body" {
+		body["type_id"] = 32
+		body["type"] = "Metal-rich body"
+	} else if planetClass == "Rocky body" {
+		body["type_id"] = 33
+		body["type"] = "Rocky body"
+	} else if planetClass == "Rocky ice body" {
+		body["type_id"] = 34
+		body["type"] = "Rocky ice world"
+	} else if planetClass == "Water giant" {
+		body["type_id"] = 35
+		body["type"] = "Water giant"
+	} else if planetClass == "Water world" {
+		body["type_id"] = 36
+		body["type"] = "Water world"
+	}
+	if event.Volcanism != "" && event.Volcanism != "No volcanism" {
+		volcanism := event.Volcanism
+		volcanismJson := make(map[string]interface{})
+		volcanism = strings.Replace(volcanism, " volcanism", "", 1)
+		// Volcanism type
+		if strings.HasSuffix(volcanism, " geysers") {
+			volcanism = strings.Replace(volcanism, " geysers", "", 1)
+			volcanismJson["type"] = "Geysers"
+		} else if strings.HasSuffix(volcanism, " magma") {
+			volcanism = strings.Replace(volcanism, " magma", "", 1)
+			volcanismJson["type"] = "Magma"
+		}
+		// Volcanism amount
+		if strings.HasPrefix(volcanism, "major") {
+			volcanism = strings.Replace(volcanism, "major ", "", 1)
+			volcanismJson["amount"] = "Major"
+		} else if strings.HasPrefix(volcanism, "minor") {
+			volcanism = strings.Replace(volcanism, "minor ", "", 1)
+			volcanismJson["amount"] = "Minor"
+		}
+		// Volcanism composition
+		volcanismJson["composition"] = TranslateVolcanism(volcanism)
+		body["volcanism"] = volcanismJson
+	}
+	// Atmosphere
+	if event.AtmosphereType != nil {
+		body["atmosphere_type_name"] = TranslateAtmosphere(event.Atmosphere, *event.AtmosphereType)
+	}
+	// Atmosphere composition
+	if len(event.AtmosphereComposition) > 0 {
+		// Build atmosphere composition
+		var componentsJson []map[string]interface{}
+		componentsJson = make([]map[string]interface{}, len(event.AtmosphereComposition))
+		// transform each
+		for i, component := range event.AtmosphereComposition {
+			var componentJson map[string]interface{}
+			componentJson = make(map[string]interface{})
+			componentJson["atmosphere_component_name"] = TranslateAtmosphereComponent(component.Name)
+			componentJson["share"] = component.Percent
+			componentsJson[i] = componentJson
+		}
+		body["atmosphere_composition"] = componentsJson
+	}
+	// Solid composition
+	if len(event.Composition) > 0 {
+		// Build solid composition
+		var componentsJson []map[string]interface{}
+		for _, name := range []string{"Ice", "Rock", "Metal"} {
+			share := event.Composition[name]
+			if share == 0 {
+				continue
 			}
+			var componentJson map[string]interface{}
+			componentJson = make(map[string]interface{})
+			componentJson["solid_component_name"] = TranslateSolidComponent(name)
+			// Journal shares are fractions; EDDB shares are percentages
+			componentJson["share"] = share * 100
+			componentsJson = append(componentsJson, componentJson)
 		}
+		if len(componentsJson) > 0 {
+			body["solid_composition"] = componentsJson
+		}
+	}
+	// Reserve level
+	if event.ReserveLevel != "" {
+		body["reserve_type_name"] = TranslateReserve(event.ReserveLevel)
+	}
+
+	// Create or update
+	bodystr, err := json.Marshal(body)
+	if err != nil {
+		return err
 	}
+
+	if exists {
+		bodyId, err := Int(body["id"])
+		if err != nil {
+			return err
+		}
+		err = UpdateBody(bodyId, string(bodystr))
+		if err != nil {
+			return err
+		}
+	} else {
+		err = InsertBody(systemId, bodyname, string(bodystr))
+		if err != nil {
+			return err
+		}
+	}
+
+	logging.Info("Body scanned", logging.Fields{"system": systemname, "body": bodyname})
+	return nil
 }
 
-func HandleOutfitting2Schema(raw string, message map[string]interface{}, publisher *zmq.Socket) {
-	// Obtain the system
-	systemname := message["systemName"].(string)
-	systemdata, err := FetchFirstSystem(systemname)
-	if err == nil {
-		// Turn the system in to JSON
-		d := json.NewDecoder(strings.NewReader(systemdata))
-		d.UseNumber()
-		var system map[string]interface{}
-		err = d.Decode(&system)
-		if errFound(err, raw) {
-			return
+func HandleStarScanEvent(event *eddn.ScanEvent, publisher *zmq.Socket) error {
+	systemname := event.StarSystem
+	bodyname := event.BodyName
+
+	// Fetch the current system from the database
+	systemx, systemy, systemz := fixCoords(event.StarPos)
+	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
+	if err != nil {
+		// System doesn't exist - ignore
+		return nil
+	}
+
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
+
+	// Now fetch the body
+	systemId, err := Int(system["id"])
+	if err != nil {
+		return err
+	}
+	body, err := FetchBody(systemId, bodyname)
+	var exists bool
+	if err != nil {
+		exists = false
+		body = make(map[string]interface{})
+		body["created_at"] = int32(time.Now().Unix())
+	} else {
+		exists = true
+	}
+
+	body["updated_at"] = int32(time.Now().Unix())
+
+	// Age
+	if event.AgeMY != nil {
+		body["age"] = *event.AgeMY
+	}
+	// Periapsis
+	if event.Periapsis != nil {
+		body["arg_of_periapsis"] = *event.Periapsis
+	}
+	// Distance
+	var distance float64
+	if event.DistanceFromArrivalLS != nil {
+		distance = *event.DistanceFromArrivalLS
+		body["distance_to_arrival"] = distance
+	}
+	body["group_id"] = 2
+	body["group_name"] = "Star"
+	body["is_landable"] = 0
+	if distance == 0 {
+		body["is_main_star"] = true
+	} else {
+		body["is_main_star"] = false
+	}
+	body["is_rotational_period_tidally_locked"] = false
+	body["name"] = bodyname
+	// Orbital eccentricity
+	if event.Eccentricity != nil {
+		body["orbital_eccentricity"] = *event.Eccentricity
+	}
+	// Orbital inclination
+	if event.OrbitalInclination != nil {
+		body["orbital_inclination"] = *event.OrbitalInclination
+	}
+	// Orbital period
+	if event.OrbitalPeriod != nil {
+		body["orbital_period"] = *event.OrbitalPeriod
+	}
+	// Rotational period
+	if event.RotationPeriod != nil {
+		body["rotational_period"] = *event.RotationPeriod / 86400
+	}
+	// Semi-major axis
+	if event.SemiMajorAxis != nil {
+		body["semi_major_axis"] = *event.SemiMajorAxis / 149597870700
+	}
+	// Stellar mass
+	if event.StellarMass != nil {
+		body["solar_masses"] = *event.StellarMass
+	}
+	// Radius
+	if event.Radius != nil {
+		body["solar_radius"] = *event.Radius / 695700000
+	}
+	// Stellar class
+	body["spectral_class"] = event.StarType
+	// Surface temperature
+	if event.SurfaceTemperature != nil {
+		body["surface_temperature"] = *event.SurfaceTemperature
+	}
+
+	// Create or update
+	bodystr, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		bodyId, err := Int(body["id"])
+		if err != nil {
+			return err
+		}
+		err = UpdateBody(bodyId, string(bodystr))
+		if err != nil {
+			return err
+		}
+	} else {
+		err = InsertBody(systemId, bodyname, string(bodystr))
+		if err != nil {
+			return err
 		}
+	}
 
-		// Obtain the station
-		stationname := message["stationName"].(string)
-		systemId, err := Int(system["id"])
-		if errFound(err, raw) {
-			return
+	// A scan of the main star is authoritative for the system's star class, whatever NavRoute
+	// recorded before
+	if event.DistanceFromArrivalLS != nil && distance == 0 && event.StarType != "" && JsonString(system["primary_star_class"]) != event.StarType {
+		system["primary_star_class"] = event.StarType
+		updatedSystem, err := json.Marshal(system)
+		if err != nil {
+			return err
 		}
-		stationdata, err := FetchStation(systemId, stationname)
-		if err == nil {
-			// Turn the station in to JSON
-			d := json.NewDecoder(strings.NewReader(stationdata))
+		err = UpdateSystem(systemId, string(updatedSystem))
+		if err != nil {
+			return err
+		}
+	}
+	logging.Info("Star scanned", logging.Fields{"system": systemname, "body": bodyname})
+	return nil
+}
+
+func HandleBodyCountEvent(event *eddn.BodyCountEvent, publisher *zmq.Socket) error {
+	bodyCount, allBodiesFound := event.Bodies()
+	return UpdateSystemBodyCount(event.System(), event.StarPos, bodyCount, allBodiesFound)
+}
+
+func HandleNavRouteSchema(message *eddn.NavRouteMessage, publisher *zmq.Socket) error {
+	for _, hop := range message.Route {
+		systemname := hop.StarSystem
+		starclass := hop.StarClass
+
+		// Fetch the current system from the database
+		systemx, systemy, systemz := fixCoords(hop.StarPos)
+		systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
+		if err != nil {
+			// System doesn't exist - make it.  We don't know anything about its state so we leave
+			// updated_at unset, allowing the first FSDJump in to fill it in
+			var dbsystem map[string]interface{}
+			dbsystem = make(map[string]interface{})
+			dbsystem["name"] = systemname
+			dbsystem["x"] = systemx
+			dbsystem["y"] = systemy
+			dbsystem["z"] = systemz
+			dbsystem["is_populated"] = false
+			if starclass != "" {
+				dbsystem["primary_star_class"] = starclass
+			}
+			dbsystemstr, err := json.Marshal(dbsystem)
+			if err != nil {
+				return err
+			}
+
+			err = InsertSystem(systemname, systemx, systemy, systemz, string(dbsystemstr))
+			if err != nil {
+				return err
+			}
+		} else if starclass != "" {
+			// Turn the system in to JSON
+			d := json.NewDecoder(strings.NewReader(systemdata))
 			d.UseNumber()
-			var station map[string]interface{}
-			err = d.Decode(&station)
-			if errFound(err, raw) {
-				return
+			var system map[string]interface{}
+			err = d.Decode(&system)
+			if err != nil {
+				return err
 			}
-			stationId, err := Int(station["id"])
-			if errFound(err, raw) {
-				return
+
+			// Record the star class if we do not already have it.  A scan of the main star
+			// replaces it
+			if JsonString(system["primary_star_class"]) == "" {
+				system["primary_star_class"] = starclass
+				updatedSystem, err := json.Marshal(system)
+				if err != nil {
+					return err
+				}
+				systemId, err := Int(system["id"])
+				if err != nil {
+					return err
+				}
+				err = UpdateSystem(systemId, string(updatedSystem))
+				if err != nil {
+					return err
+				}
 			}
+		}
+	}
+	return nil
+}
+
+func HandleCodexEntrySchema(message *eddn.CodexEntryMessage, publisher *zmq.Socket) error {
+	systemname := message.System
+	bodyname := message.BodyName
+	entryId := message.EntryID
+
+	// Fetch the current system from the database
+	systemx, systemy, systemz := fixCoords(message.StarPos)
+	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
+	if err != nil {
+		// System doesn't exist - ignore
+		return nil
+	}
+
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
+	systemId, err := Int(system["id"])
+	if err != nil {
+		return err
+	}
+
+	entry, err := FetchCodexEntry(systemId, entryId, bodyname)
+	var exists bool
+	if err != nil {
+		exists = false
+		entry = make(map[string]interface{})
+		entry["created_at"] = int32(time.Now().Unix())
+	} else {
+		exists = true
+	}
+
+	entry["updated_at"] = int32(time.Now().Unix())
+	entry["entry_id"] = entryId
+	entry["name"] = TranslateCodex(message.Name)
+	entry["category"] = TranslateCodex(message.Category)
+	entry["subcategory"] = TranslateCodex(message.SubCategory)
+	entry["region"] = TranslateCodex(message.Region)
+	entry["system_id"] = systemId
+	entry["system_name"] = systemname
+	if bodyname != "" {
+		entry["body_name"] = bodyname
+		body, err := FetchBody(systemId, bodyname)
+		if err == nil && body["id"] != nil {
+			entry["body_id"] = body["id"]
+		}
+	}
+	if message.Latitude != nil {
+		entry["latitude"] = *message.Latitude
+	}
+	if message.Longitude != nil {
+		entry["longitude"] = *message.Longitude
+	}
+
+	// Create or update
+	entrystr, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = UpsertCodexEntry(systemId, entryId, bodyname, JsonString(entry["name"]), string(entrystr))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		logging.Info("Codex entry recorded", logging.Fields{"system": systemname, "entry": entry["name"]})
+	}
+	return nil
+}
+
+func HandleApproachSettlementSchema(message *eddn.ApproachSettlementMessage, publisher *zmq.Socket) error {
+	systemname := message.StarSystem
+	settlementname := message.Name
+	bodyname := message.BodyName
+
+	// Fetch the current system from the database
+	systemx, systemy, systemz := fixCoords(message.StarPos)
+	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
+	if err != nil {
+		// System doesn't exist - ignore
+		return nil
+	}
+
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
+	systemId, err := Int(system["id"])
+	if err != nil {
+		return err
+	}
+
+	var station map[string]interface{}
+	var exists bool
+	stationdata, err := FetchSettlement(systemId, settlementname, message.MarketID)
+	if err != nil {
+		exists = false
+		station = make(map[string]interface{})
+		station["created_at"] = int32(time.Now().Unix())
+	} else {
+		exists = true
+		// Turn the station into JSON
+		d2 := json.NewDecoder(strings.NewReader(stationdata))
+		d2.UseNumber()
+		err = d2.Decode(&station)
+		if err != nil {
+			return err
+		}
+
+		// Only if the message's timestamp is after the last time we updated the data
+		if message.Time.Unix() <= IntOr(station["updated_at"], 0) {
+			return nil
+		}
+	}
+
+	// Updates are ordered by the time of the event rather than when we received it
+	station["name"] = settlementname
+	station["system_id"] = systemId
+	station["updated_at"] = int32(message.Time.Unix())
+	station["is_planetary"] = true
+	if station["type"] == nil {
+		station["type"] = "Odyssey Settlement"
+	}
+	if message.MarketID != nil {
+		station["ed_market_id"] = *message.MarketID
+	}
+	// Body
+	if bodyname != "" {
+		station["body_name"] = bodyname
+		body, err := FetchBody(systemId, bodyname)
+		if err == nil && body["id"] != nil {
+			station["body_id"] = body["id"]
+		}
+	}
+	// Location
+	if message.Latitude != nil {
+		station["latitude"] = *message.Latitude
+	}
+	if message.Longitude != nil {
+		station["longitude"] = *message.Longitude
+	}
+	// Faction; only present for populated settlements
+	if message.StationFaction != nil {
+		station["controlling_faction"] = message.StationFaction.Name
+		station["state"] = TranslateState(message.StationFaction.FactionState)
+	}
+	if message.StationAllegiance != "" {
+		station["allegiance"] = TranslateAllegiance(message.StationAllegiance)
+	}
+	if message.StationGovernment != "" {
+		station["government"] = TranslateGovernment(message.StationGovernment)
+	}
+	if message.StationEconomy != "" {
+		station["primary_economy"] = TranslateEconomy(message.StationEconomy)
+	}
+
+	// Create or update
+	stationstr, err := json.Marshal(station)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		stationId, err := Int(station["id"])
+		if err != nil {
+			return err
+		}
+		err = UpdateStation(systemId, stationId, string(stationstr))
+		if err != nil {
+			return err
+		}
+		logging.Info("Settlement updated", logging.Fields{"system": systemname, "station": settlementname})
+	} else {
+		err = InsertStation(systemId, settlementname, string(stationstr))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateSystemBodyCount records the number of bodies in a system as reported by the FSS or a nav beacon
+func UpdateSystemBodyCount(systemname string, starPos []float64, bodyCount int64, allBodiesFound bool) error {
+	// Fetch the current system from the database
+	systemx, systemy, systemz := fixCoords(starPos)
+	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
+	if err != nil {
+		// System doesn't exist - ignore
+		return nil
+	}
+
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
+
+	// The body count for a system never changes, so there is nothing to do if we already have it
+	dbAllBodiesFound, _ := system["all_bodies_found"].(bool)
+	if IntOr(system["body_count"], -1) == bodyCount && (dbAllBodiesFound || !allBodiesFound) {
+		return nil
+	}
+
+	// Note that we leave updated_at alone, as that tracks the system's political state
+	system["body_count"] = bodyCount
+	if allBodiesFound {
+		system["all_bodies_found"] = true
+	}
+	updatedSystem, err := json.Marshal(system)
+	if err != nil {
+		return err
+	}
+	systemId, err := Int(system["id"])
+	if err != nil {
+		return err
+	}
+	err = UpdateSystem(systemId, string(updatedSystem))
+	if err != nil {
+		return err
+	}
+
+	logging.Info("Body count updated", logging.Fields{"system": systemname, "body_count": bodyCount})
+	return nil
+}
+
+func HandleDockedEvent(event *eddn.DockedEvent, publisher *zmq.Socket) error {
+	systemname := event.StarSystem
+	stationname := event.StationName
+
+	stationfaction := ""
+	if event.StationFaction != nil {
+		stationfaction = event.StationFaction.Name
+	}
+
+	// For 'Docked' events a missing allegiance implies Independent
+	stationallegiance := "Faction_Independent"
+	if event.StationAllegiance != nil {
+		stationallegiance = *event.StationAllegiance
+	}
+	stationallegiance = TranslateAllegiance(stationallegiance)
+
+	stationeconomy := TranslateEconomy(event.StationEconomy)
+
+	stationgovernment := TranslateGovernment(event.StationGovernment)
+
+	stationstate := TranslateState(event.FactionState)
+
+	// Fetch the current system from the database
+	systemx, systemy, systemz := fixCoords(event.StarPos)
+	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
+	if err != nil {
+		// System doesn't exist - ignore
+		return nil
+	}
+
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
+
+	// Only if the event's timestamp is after the last time we updated the data
+	updateTime := IntOr(system["updated_at"], 0)
+	if event.Time.Unix() <= updateTime {
+		return nil
+	}
+
+	systemId, err := Int(system["id"])
+	if err != nil {
+		return err
+	}
+
+	stationdata, err := FetchStation(systemId, stationname)
+	if err != nil {
+		// Station doesn't exist - ignore
+		return nil
+	}
+
+	// Turn the station into JSON
+	d2 := json.NewDecoder(strings.NewReader(stationdata))
+	d2.UseNumber()
+	var station map[string]interface{}
+	err = d2.Decode(&station)
+	if err != nil {
+		return err
+	}
+
+	var update map[string]interface{}
+	update = make(map[string]interface{})
+
+	updaterequired := false
+
+	dballegiance := JsonString(station["allegiance"])
+	if dballegiance != stationallegiance {
+		updaterequired = true
+		logging.Info("Station allegiance changed", logging.Fields{"system": system["name"], "station": stationname, "from": dballegiance, "to": stationallegiance})
+		if dballegiance != "" {
+			update["oldallegiance"] = dballegiance
+			update["newallegiance"] = stationallegiance
+		}
+	}
 
-			// Only if the message's timestamp is after the last time we updated the data
-			messageTime, err := time.Parse(time.RFC3339, message["timestamp"].(string))
-			if errFound(err, raw) {
-				return
-			}
-			updateTime := IntOr(station["outfitting_updated_at"], 0)
-			if errFound(err, raw) {
-				return
-			}
-			if messageTime.Unix() > updateTime {
-				station["selling_modules"] = message["modules"]
-
-				// Update timestamp
-				station["outfitting_updated_at"] = int32(time.Now().Unix())
-				dbstation, err := json.Marshal(station)
-				err = UpdateStation(systemId, stationId, string(dbstation))
-				if errFound(err, raw) {
-					return
-				}
+	dbeconomy := JsonString(station["primary_economy"])
+	if dbeconomy != stationeconomy {
+		updaterequired = true
+		logging.Info("Station economy changed", logging.Fields{"system": system["name"], "station": stationname, "from": dbeconomy, "to": stationeconomy})
+		if dbeconomy != "" {
+			update["oldeconomy"] = dbeconomy
+			update["neweconomy"] = stationeconomy
+		}
+	}
 
-				log.Print(stationname, "@", systemname, " outfitting updated")
-			}
+	dbgovernment := JsonString(station["government"])
+	if dbgovernment != stationgovernment {
+		updaterequired = true
+		logging.Info("Station government changed", logging.Fields{"system": system["name"], "station": stationname, "from": dbgovernment, "to": stationgovernment})
+		if dbgovernment != "" {
+			update["oldgovernment"] = dbgovernment
+			update["newgovernment"] = stationgovernment
 		}
 	}
-}
 
-func HandleCommodity3Schema(raw string, message map[string]interface{}, publisher *zmq.Socket) {
-	// Obtain the system
-	systemname := message["systemName"].(string)
-	systemdata, err := FetchFirstSystem(systemname)
-	if err == nil {
-		// Turn the system in to JSON
-		d := json.NewDecoder(strings.NewReader(systemdata))
-		d.UseNumber()
-		var system map[string]interface{}
-		err = d.Decode(&system)
-		if errFound(err, raw) {
-			return
+	dbfaction := JsonString(station["controlling_faction"])
+	if dbfaction != stationfaction {
+		updaterequired = true
+		logging.Info("Station controlling faction changed", logging.Fields{"system": system["name"], "station": stationname, "from": dbfaction, "to": stationfaction})
+		if dbfaction != "" {
+			update["oldfaction"] = dbfaction
+			update["newfaction"] = stationfaction
 		}
+	}
 
-		// Obtain the station
-		stationname := message["stationName"].(string)
-		systemId, err := Int(system["id"])
-		if errFound(err, raw) {
-			return
+	dbstate := JsonString(station["state"])
+	if dbstate != stationstate {
+		updaterequired = true
+		logging.Info("Station state changed", logging.Fields{"system": system["name"], "station": stationname, "from": dbstate, "to": stationstate})
+		if dbstate != "" {
+			update["oldstate"] = dbstate
+			update["newstate"] = stationstate
 		}
-		stationdata, err := FetchStation(systemId, stationname)
-		if err == nil {
-			// Turn the station in to JSON
-			d := json.NewDecoder(strings.NewReader(stationdata))
-			d.UseNumber()
-			var station map[string]interface{}
-			err = d.Decode(&station)
-			if errFound(err, raw) {
-				return
-			}
-			stationId, err := Int(station["id"])
-			if errFound(err, raw) {
-				return
-			}
+	}
 
-			// Only if the message's timestamp is after the last time we updated the data
-			messageTime, err := time.Parse(time.RFC3339, message["timestamp"].(string))
-			if errFound(err, raw) {
-				return
-			}
-			updateTime := IntOr(station["market_updated_at"], 0)
-			if messageTime.Unix() > updateTime {
+	if updaterequired {
+		// Update the database
+		station["allegiance"] = stationallegiance
+		station["primary_economy"] = stationeconomy
+		station["government"] = stationgovernment
+		station["state"] = stationstate
+		station["updated_at"] = int32(time.Now().Unix())
+		station["controlling_faction"] = stationfaction
+		updatedStation, err := json.Marshal(station)
+		if err != nil {
+			return err
+		}
+		stationId, err := Int(station["id"])
+		if err != nil {
+			return err
+		}
+		err = UpdateStation(systemId, stationId, string(updatedStation))
+		if err != nil {
+			return err
+		}
 
-				commodities := message["commodities"].([]interface{})
+		// Send notification
+		update["systemname"] = systemname
+		update["stationname"] = stationname
+		update["x"] = systemx
+		update["y"] = systemy
+		update["z"] = systemz
+		updateJson, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+		Publish(publisher, "eddp.delta.station", string(updateJson))
+	}
+	return nil
+}
 
-				// Build updated commodities
-				var dbcommodities []map[string]interface{}
-				dbcommodities = make([]map[string]interface{}, len(commodities))
-				// transform each
-				for i := range commodities {
-					var dbcommodity map[string]interface{}
-					dbcommodity = make(map[string]interface{})
+func HandleOutfitting2Schema(message *eddn.OutfittingMessage, publisher *zmq.Socket) error {
+	// Obtain the system
+	systemname := message.SystemName
+	systemdata, err := FetchFirstSystem(systemname)
+	if err != nil {
+		// System doesn't exist - ignore
+		return nil
+	}
 
-					commodity := commodities[i].(map[string]interface{})
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
 
-					// Obtain name and ID
-					name := commodity["name"]
-					name = TranslateCommodity(name.(string))
-					dbcommodity["name"] = name
+	// Obtain the station
+	stationname := message.StationName
+	systemId, err := Int(system["id"])
+	if err != nil {
+		return err
+	}
+	stationdata, err := FetchStation(systemId, stationname)
+	if err != nil {
+		// Station doesn't exist - ignore
+		return nil
+	}
 
-					id, exists := dataDefs.CommodityIDs[name.(string)]
-					if !exists {
-						id = -1
-					}
-					dbcommodity["id"] = id
-
-					// See if it is being sold
-					var stockbracket int64
-					tmpstockbracket := commodity["stockBracket"]
-					switch t := tmpstockbracket.(type) {
-					case json.Number:
-						stockbracket, err = tmpstockbracket.(json.Number).Int64()
-						if errFound(err, raw) {
-							return
-						}
-					case string:
-						// This can happen if the stock bracket is "", which is rather surprisingly
-						// a valid value and means "not normally but at the moment yes"
-						stockbracket = 3
-					default:
-						log.Print("unexpected type %T\n", t)
-					}
-					if stockbracket > 0 {
-						stock, err := Int(commodity["stock"])
-						if errFound(err, raw) {
-							return
-						}
-						if stock > 0 {
-							dbcommodity["supply"] = stock
-							price, err := Int(commodity["buyPrice"])
-							if errFound(err, raw) {
-								return
-							}
-							dbcommodity["buy_price"] = price
-						}
-					}
-					// See if it is being bought
-					var demandbracket int64
-					tmpdemandbracket := commodity["demandBracket"]
-					switch t := tmpdemandbracket.(type) {
-					case json.Number:
-						demandbracket, err = tmpdemandbracket.(json.Number).Int64()
-						if errFound(err, raw) {
-							return
-						}
-					case string:
-						// This can happen if the demand bracket is "", which is rather surprisingly
-						// a valid value and means "not normally but at the moment yes"
-						demandbracket = 3
-					default:
-						log.Print("unexpected type %T\n", t)
-					}
-					if demandbracket > 0 {
-						demand, err := Int(commodity["demand"])
-						if errFound(err, raw) {
-							return
-						}
-						if demand > 0 {
-							dbcommodity["demand"] = demand
-							price, err := Int(commodity["sellPrice"])
-							if errFound(err, raw) {
-								return
-							}
-							dbcommodity["sell_price"] = price
-						}
-					}
-					dbcommodities[i] = dbcommodity
-				}
+	// Turn the station in to JSON
+	d = json.NewDecoder(strings.NewReader(stationdata))
+	d.UseNumber()
+	var station map[string]interface{}
+	err = d.Decode(&station)
+	if err != nil {
+		return err
+	}
+	stationId, err := Int(station["id"])
+	if err != nil {
+		return err
+	}
 
-				// Replace existing station commodities
-				station["commodities"] = dbcommodities
+	// Only if the message's timestamp is after the last time we updated the data
+	updateTime := IntOr(station["outfitting_updated_at"], 0)
+	if message.Time.Unix() <= updateTime {
+		return nil
+	}
 
-				// Update timestamp
-				station["market_updated_at"] = int32(time.Now().Unix())
-				dbstation, err := json.Marshal(station)
-				err = UpdateStation(systemId, stationId, string(dbstation))
-				if errFound(err, raw) {
-					return
-				}
+	station["selling_modules"] = message.Modules
 
-				log.Print(stationname, "@", systemname, " market updated")
-			}
-		}
+	// Update timestamp
+	station["outfitting_updated_at"] = int32(time.Now().Unix())
+	dbstation, err := json.Marshal(station)
+	if err != nil {
+		return err
+	}
+	err = UpdateStation(systemId, stationId, string(dbstation))
+	if err != nil {
+		return err
 	}
+
+	logging.Info("Outfitting updated", logging.Fields{"system": systemname, "station": stationname})
+	return nil
 }
 
-func HandleFSDJumpEvent(raw string, event map[string]interface{}, publisher *zmq.Socket) {
-	systemname := event["StarSystem"].(string)
+func HandleCommodity3Schema(message *eddn.CommodityMessage, publisher *zmq.Socket) error {
+	// Obtain the system
+	systemname := message.SystemName
+	systemdata, err := FetchFirstSystem(systemname)
+	if err != nil {
+		// System doesn't exist - ignore
+		return nil
+	}
+
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
 
-	systemsecurity := event["SystemSecurity"]
-	if systemsecurity == nil {
-		systemsecurity = ""
+	// Obtain the station
+	stationname := message.StationName
+	systemId, err := Int(system["id"])
+	if err != nil {
+		return err
+	}
+	stationdata, err := FetchStation(systemId, stationname)
+	if err != nil {
+		// Station doesn't exist - ignore
+		return nil
 	}
-	systemsecurity = TranslateSecurity(systemsecurity.(string))
 
-	systemallegiance := event["SystemAllegiance"]
-	if systemallegiance == nil {
-		systemallegiance = ""
+	// Turn the station in to JSON
+	d = json.NewDecoder(strings.NewReader(stationdata))
+	d.UseNumber()
+	var station map[string]interface{}
+	err = d.Decode(&station)
+	if err != nil {
+		return err
+	}
+	stationId, err := Int(station["id"])
+	if err != nil {
+		return err
 	}
-	systemallegiance = TranslateAllegiance(systemallegiance.(string))
 
-	systemeconomy := event["SystemEconomy"]
-	if systemeconomy == nil {
-		systemeconomy = ""
+	// Only if the message's timestamp is after the last time we updated the data
+	updateTime := IntOr(station["market_updated_at"], 0)
+	if message.Time.Unix() <= updateTime {
+		return nil
 	}
-	systemeconomy = TranslateEconomy(systemeconomy.(string))
 
-	systemgovernment := event["SystemGovernment"]
-	if systemgovernment == nil {
-		systemgovernment = ""
+	// Build updated commodities
+	var dbcommodities []map[string]interface{}
+	dbcommodities = make([]map[string]interface{}, len(message.Commodities))
+	// transform each
+	for i, commodity := range message.Commodities {
+		var dbcommodity map[string]interface{}
+		dbcommodity = make(map[string]interface{})
+
+		// Obtain name and ID
+		name := TranslateCommodity(commodity.Name)
+		dbcommodity["name"] = name
+
+		id, exists := dataDefs.CommodityIDs[name]
+		if !exists {
+			id = -1
+		}
+		dbcommodity["id"] = id
+
+		// See if it is being sold
+		if commodity.StockBracket > 0 && commodity.Stock > 0 {
+			dbcommodity["supply"] = commodity.Stock
+			dbcommodity["buy_price"] = commodity.BuyPrice
+		}
+		// See if it is being bought
+		if commodity.DemandBracket > 0 && commodity.Demand > 0 {
+			dbcommodity["demand"] = commodity.Demand
+			dbcommodity["sell_price"] = commodity.SellPrice
+		}
+		dbcommodities[i] = dbcommodity
 	}
-	systemgovernment = TranslateGovernment(systemgovernment.(string))
 
-	systemstate := event["FactionState"]
-	if systemstate == nil {
-		systemstate = ""
+	// Replace existing station commodities
+	station["commodities"] = dbcommodities
+
+	// Update timestamp
+	station["market_updated_at"] = int32(time.Now().Unix())
+	dbstation, err := json.Marshal(station)
+	if err != nil {
+		return err
+	}
+	err = UpdateStation(systemId, stationId, string(dbstation))
+	if err != nil {
+		return err
 	}
-	systemstate = TranslateState(systemstate.(string))
 
-	// Fetch the current information from the DB
-	systemx, err := Float(event["StarPos"].([]interface{})[0])
-	assertNil(err)
-	systemx = fixCoord(systemx)
-	systemy, err := Float(event["StarPos"].([]interface{})[1])
-	assertNil(err)
-	systemy = fixCoord(systemy)
-	systemz, err := Float(event["StarPos"].([]interface{})[2])
-	assertNil(err)
-	systemz = fixCoord(systemz)
+	logging.Info("Market updated", logging.Fields{"system": systemname, "station": stationname})
+	return nil
+}
+
+func HandleFSDJumpEvent(event *eddn.FSDJumpEvent, publisher *zmq.Socket) error {
+	systemname := event.StarSystem
+
+	systemsecurity := TranslateSecurity(event.SystemSecurity)
+
+	systemallegiance := TranslateAllegiance(event.SystemAllegiance)
 
+	systemeconomy := TranslateEconomy(event.SystemEconomy)
+
+	systemgovernment := TranslateGovernment(event.SystemGovernment)
+
+	systemstate := TranslateState(event.FactionState)
+
+	// Fetch the current information from the DB
+	systemx, systemy, systemz := fixCoords(event.StarPos)
 	systemdata, err := FetchSystem(systemname, systemx, systemy, systemz)
 	if err != nil {
 		// System doesn't exist - make it
@@ -1017,126 +2304,133 @@ func HandleFSDJumpEvent(raw string, event map[string]interface{}, publisher *zmq
 		dbsystem["primary_economy"] = systemeconomy
 		dbsystem["updated_at"] = int32(time.Now().Unix())
 		dbsystemstr, err := json.Marshal(dbsystem)
-		if errFound(err, raw) {
-			return
+		if err != nil {
+			return err
 		}
 
-		err = InsertSystem(systemname, systemx, systemy, systemz, string(dbsystemstr))
-		if errFound(err, raw) {
-			return
-		}
-	} else {
-		// Turn the system in to JSON
-		d := json.NewDecoder(strings.NewReader(systemdata))
-		d.UseNumber()
-		var system map[string]interface{}
-		err = d.Decode(&system)
-		if errFound(err, raw) {
-			return
-		}
+		return InsertSystem(systemname, systemx, systemy, systemz, string(dbsystemstr))
+	}
 
-		// Only if the event's timestamp is after the last time we updated the data
-		eventTime, err := time.Parse(time.RFC3339, event["timestamp"].(string))
-		if errFound(err, raw) {
-			return
-		}
-		updateTime, err := Int(system["updated_at"])
-		if errFound(err, raw) {
-			return
+	// Turn the system in to JSON
+	d := json.NewDecoder(strings.NewReader(systemdata))
+	d.UseNumber()
+	var system map[string]interface{}
+	err = d.Decode(&system)
+	if err != nil {
+		return err
+	}
+
+	// Only if the event's timestamp is after the last time we updated the data
+	// Systems discovered from plotted routes have never been updated
+	updateTime := IntOr(system["updated_at"], 0)
+	if event.Time.Unix() <= updateTime {
+		return nil
+	}
+
+	// Systems discovered from plotted routes don't know if they are populated until someone jumps in
+	population := event.Population
+	newlypopulated := system["is_populated"] != true && population > 0
+
+	// State/econonmy etc. is only valid if the system is populated
+	if system["is_populated"] != true && !newlypopulated {
+		return nil
+	}
+
+	var update map[string]interface{}
+	update = make(map[string]interface{})
+
+	updaterequired := false
+
+	if newlypopulated {
+		updaterequired = true
+		logging.Info("System now populated", logging.Fields{"system": systemname, "population": population})
+		system["is_populated"] = true
+		system["population"] = population
+	}
+
+	dbsecurity := JsonString(system["security"])
+	if dbsecurity != systemsecurity {
+		updaterequired = true
+		logging.Info("System security changed", logging.Fields{"system": systemname, "from": dbsecurity, "to": systemsecurity})
+		if dbsecurity != "" {
+			update["oldsecurity"] = dbsecurity
+			update["newsecurity"] = systemsecurity
 		}
-		if eventTime.Unix() > updateTime {
-			// State/econonmy etc. is only valid if the system is populated
-			if system["is_populated"].(bool) == true {
-				var update map[string]interface{}
-				update = make(map[string]interface{})
-
-				updaterequired := false
-
-				dbsecurity := JsonString(system["security"])
-				if dbsecurity != systemsecurity {
-					updaterequired = true
-					log.Print(systemname, " system security ", dbsecurity, " -> ", systemsecurity)
-					if dbsecurity != "" {
-						update["oldsecurity"] = dbsecurity
-						update["newsecurity"] = systemsecurity
-					}
-				}
+	}
 
-				dballegiance := JsonString(system["allegiance"])
-				if dballegiance != systemallegiance {
-					updaterequired = true
-					log.Print(systemname, " system allegiance ", dballegiance, " -> ", systemallegiance)
-					if dballegiance != "" {
-						update["oldallegiance"] = dballegiance
-						update["newallegiance"] = systemallegiance
-					}
-				}
+	dballegiance := JsonString(system["allegiance"])
+	if dballegiance != systemallegiance {
+		updaterequired = true
+		logging.Info("System allegiance changed", logging.Fields{"system": systemname, "from": dballegiance, "to": systemallegiance})
+		if dballegiance != "" {
+			update["oldallegiance"] = dballegiance
+			update["newallegiance"] = systemallegiance
+		}
+	}
 
-				dbeconomy := JsonString(system["primary_economy"])
-				if dbeconomy != systemeconomy {
-					updaterequired = true
-					log.Print(systemname, " system economy ", dbeconomy, " -> ", systemstate)
-					if dbeconomy != "" {
-						update["oldeconomy"] = dbeconomy
-						update["neweconomy"] = systemeconomy
-					}
-				}
+	dbeconomy := JsonString(system["primary_economy"])
+	if dbeconomy != systemeconomy {
+		updaterequired = true
+		logging.Info("System economy changed", logging.Fields{"system": systemname, "from": dbeconomy, "to": systemeconomy})
+		if dbeconomy != "" {
+			update["oldeconomy"] = dbeconomy
+			update["neweconomy"] = systemeconomy
+		}
+	}
 
-				dbgovernment := JsonString(system["government"])
-				if dbgovernment != systemgovernment {
-					updaterequired = true
-					log.Print(systemname, " system government ", dbgovernment, " -> ", systemstate)
-					if dbgovernment != "" {
-						update["oldgovernment"] = dbgovernment
-						update["newgovernment"] = systemgovernment
-					}
-				}
+	dbgovernment := JsonString(system["government"])
+	if dbgovernment != systemgovernment {
+		updaterequired = true
+		logging.Info("System government changed", logging.Fields{"system": systemname, "from": dbgovernment, "to": systemgovernment})
+		if dbgovernment != "" {
+			update["oldgovernment"] = dbgovernment
+			update["newgovernment"] = systemgovernment
+		}
+	}
 
-				dbstate := JsonString(system["state"])
-				if dbstate != systemstate {
-					updaterequired = true
-					log.Print(systemname, " system state ", dbstate, " -> ", systemstate)
-					if dbstate != "" {
-						update["oldstate"] = dbstate
-						update["newstate"] = systemstate
-					}
-				}
+	dbstate := JsonString(system["state"])
+	if dbstate != systemstate {
+		updaterequired = true
+		logging.Info("System state changed", logging.Fields{"system": systemname, "from": dbstate, "to": systemstate})
+		if dbstate != "" {
+			update["oldstate"] = dbstate
+			update["newstate"] = systemstate
+		}
+	}
 
-				if updaterequired {
-					// Update the database
-					system["security"] = systemsecurity
-					system["allegiance"] = systemallegiance
-					system["primary_economy"] = systemeconomy
-					system["government"] = systemgovernment
-					system["state"] = systemstate
-					system["updated_at"] = int32(time.Now().Unix())
-					updatedSystem, err := json.Marshal(system)
-					if errFound(err, raw) {
-						return
-					}
-					systemId, err := Int(system["id"])
-					if errFound(err, raw) {
-						return
-					}
-					UpdateSystem(systemId, string(updatedSystem))
-					if errFound(err, raw) {
-						return
-					}
+	if updaterequired {
+		// Update the database
+		system["security"] = systemsecurity
+		system["allegiance"] = systemallegiance
+		system["primary_economy"] = systemeconomy
+		system["government"] = systemgovernment
+		system["state"] = systemstate
+		system["updated_at"] = int32(time.Now().Unix())
+		updatedSystem, err := json.Marshal(system)
+		if err != nil {
+			return err
+		}
+		systemId, err := Int(system["id"])
+		if err != nil {
+			return err
+		}
+		err = UpdateSystem(systemId, string(updatedSystem))
+		if err != nil {
+			return err
+		}
 
-					// Send notification
-					update["systemname"] = systemname
-					update["x"] = systemx
-					update["y"] = systemy
-					update["z"] = systemz
-					updateJson, err := json.Marshal(update)
-					if errFound(err, raw) {
-						return
-					}
-					_, _ = publisher.SendMessage("eddp.delta.system", string(updateJson))
-				}
-			}
+		// Send notification
+		update["systemname"] = systemname
+		update["x"] = systemx
+		update["y"] = systemy
+		update["z"] = systemz
+		updateJson, err := json.Marshal(update)
+		if err != nil {
+			return err
 		}
+		Publish(publisher, "eddp.delta.system", string(updateJson))
 	}
+	return nil
 }
 
 func JsonString(obj interface{}) string {
@@ -1206,6 +2500,68 @@ func TranslateVolcanism(volcanism string) string {
 	return volcanism
 }
 
+func TranslateAtmosphere(atmosphere string, atmosphereType string) string {
+	if atmosphereType == "" || atmosphereType == "None" {
+		return "No atmosphere"
+	}
+	translated, present := dataDefs.Atmospheres[strings.Replace(strings.Replace(strings.Replace(strings.ToLower(atmosphereType), "$", "", -1), ";", "", -1), " ", "", -1)]
+	if !present {
+		translated = atmosphereType
+	}
+	// The atmosphere description carries the density and temperature qualifiers, e.g. "hot thick carbon dioxide atmosphere"
+	var qualifiers []string
+	for _, qualifier := range []string{"hot", "thin", "thick"} {
+		if strings.HasPrefix(atmosphere, qualifier+" ") || strings.Contains(atmosphere, " "+qualifier+" ") {
+			qualifiers = append(qualifiers, qualifier)
+		}
+	}
+	if len(qualifiers) > 0 {
+		prefix := strings.Join(qualifiers, " ")
+		return strings.ToUpper(prefix[:1]) + prefix[1:] + " " + translated
+	}
+	return translated
+}
+
+func TranslateAtmosphereComponent(component string) string {
+	if component == "" {
+		return "None"
+	}
+	if translated, present := dataDefs.AtmosphereComponents[strings.Replace(strings.Replace(strings.Replace(strings.ToLower(component), "$", "", -1), ";", "", -1), " ", "", -1)]; present {
+		return translated
+	}
+	return component
+}
+
+func TranslateSolidComponent(component string) string {
+	if component == "" {
+		return "None"
+	}
+	if translated, present := dataDefs.SolidComponents[strings.ToLower(component)]; present {
+		return translated
+	}
+	return component
+}
+
+func TranslateReserve(reserve string) string {
+	if reserve == "" {
+		return "None"
+	}
+	if translated, present := dataDefs.Reserves[strings.Replace(strings.Replace(strings.ToLower(reserve), "$", "", -1), ";", "", -1)]; present {
+		return translated
+	}
+	return reserve
+}
+
+// TranslateCodex turns a codex symbol such as "$Codex_Ent_Stratum_07_M_Name;" in to something more readable.
+// EDDN strips the localised names, so this is the best that we can do
+func TranslateCodex(symbol string) string {
+	symbol = strings.Replace(strings.Replace(symbol, "$", "", -1), ";", "", -1)
+	symbol = strings.TrimPrefix(symbol, "Codex_")
+	symbol = strings.TrimPrefix(symbol, "Ent_")
+	symbol = strings.TrimSuffix(symbol, "_Name")
+	return strings.Replace(symbol, "_", " ", -1)
+}
+
 func TranslateMaterial(material string) string {
 	if material == "" {
 		return "None"
@@ -1247,7 +2603,8 @@ func FetchBody(systemId int64, body string) (map[string]interface{}, error) {
 	d.UseNumber()
 	var bodyJson map[string]interface{}
 	err = d.Decode(&bodyJson)
-	if errFound(err, body) {
+	if err != nil {
+		logging.Error("Invalid body JSON", logging.Fields{"body": body, "error": err})
 		return bodyJson, errors.New("Invalid body JSON")
 	}
 
@@ -1275,78 +2632,112 @@ func FetchStation(systemId int64, station string) (string, error) {
 	return data, nil
 }
 
-func InsertSystem(name string, x float64, y float64, z float64, system string) error {
-	// Obtain the next ID
-	var nextId int
-	err := eddpDb.QueryRow("SELECT max(id) + 1 FROM systems").Scan(&nextId)
+// FetchSettlement finds a settlement by its market ID if it has one, which identifies it better
+// than its name, which it can share with other settlements in the system.  Failing that it
+// finds one of that name, but not one with a different market ID
+func FetchSettlement(systemId int64, name string, marketId *int64) (string, error) {
+	var data string
+	err := eddpDb.QueryRow("SELECT data FROM stations WHERE system_id = ? AND (json_extract(data, '$.ed_market_id') = ? OR (name = ? AND (? IS NULL OR json_extract(data, '$.ed_market_id') IS NULL))) ORDER BY json_extract(data, '$.ed_market_id') IS NULL LIMIT 1", systemId, marketId, name, marketId).Scan(&data)
 	if err != nil {
-		return err
+		return "", errors.New("No such station")
 	}
 
-	// Splice the ID in to the system information
-	system = system[:len(system)-1]
-	system = system + ",\"id\":"
-	system = system + strconv.Itoa(nextId)
-	system = system + "}"
-
-	log.Print(name, " created (", nextId, ")")
+	return data, nil
+}
 
-	// Retry up to 5 times...
-	retrying := 5
-	for retrying > 0 {
-		_, err = eddpDb.Exec("INSERT INTO systems(id, name, x, y, z, data) VALUES(?, ?, ?, ?, ?, ?)", nextId, name, x, y, z, system)
-		if err != nil {
-			// Failed to do it this time, wait for a second to retry
-			time.Sleep(1000 * time.Millisecond)
-			retrying--
-		} else {
-			// Success
-			break
-		}
+func FetchCodexEntry(systemId int64, entryId int64, bodyname string) (map[string]interface{}, error) {
+	var data string
+	err := eddpDb.QueryRow("SELECT data FROM codex WHERE system_id = ? AND entry_id = ? AND body_name = ?", systemId, entryId, bodyname).Scan(&data)
+	if err != nil {
+		entryJson := make(map[string]interface{})
+		return entryJson, errors.New("No such codex entry")
+	}
+	d := json.NewDecoder(strings.NewReader(data))
+	d.UseNumber()
+	var entryJson map[string]interface{}
+	err = d.Decode(&entryJson)
+	if err != nil {
+		logging.Error("Invalid codex entry JSON", logging.Fields{"data": data, "error": err})
+		return entryJson, errors.New("Invalid codex entry JSON")
 	}
+
+	return entryJson, nil
+}
+
+// UpsertCodexEntry records a codex entry, or updates it if another worker recorded it since we
+// looked, keeping the time at which it was first recorded
+func UpsertCodexEntry(systemId int64, entryId int64, bodyname string, name string, entry string) error {
+	_, err := eddpDb.Exec("INSERT INTO codex(system_id, entry_id, body_name, name, data) VALUES(?, ?, ?, ?, ?) ON CONFLICT(system_id, entry_id, body_name) DO UPDATE SET name = excluded.name, data = json_set(excluded.data, '$.created_at', COALESCE(json_extract(codex.data, '$.created_at'), json_extract(excluded.data, '$.created_at')))", systemId, entryId, bodyname, name, entry)
 	return err
 }
 
+func InsertSystem(name string, x float64, y float64, z float64, system string) error {
+	return InsertWithLocalId("systems", "name, x, y, z", name, system, name, x, y, z)
+}
+
 func UpdateSystem(systemId int64, system string) error {
 	_, err := eddpDb.Exec("UPDATE systems SET data = ? WHERE id = ?", system, systemId)
 	return err
 }
 
 func InsertBody(systemId int64, name string, body string) error {
-	// Obtain the next ID
-	var nextId int
-	err := eddpDb.QueryRow("SELECT max(id) + 1 FROM bodies").Scan(&nextId)
-	if err != nil {
-		return err
-	}
+	return InsertWithLocalId("bodies", "system_id, name", name, body, systemId, name)
+}
 
-	// Splice the ID in to the body information
-	body = body[:len(body)-1]
-	body = body + ",\"id\":"
-	body = body + strconv.Itoa(nextId)
-	body = body + "}"
+func UpdateBody(bodyId int64, body string) error {
+	_, err := eddpDb.Exec("UPDATE bodies SET data = ? WHERE id = ?", body, bodyId)
+	return err
+}
 
-	log.Print(name, " created (", nextId, ")")
+func InsertStation(systemId int64, name string, station string) error {
+	return InsertWithLocalId("stations", "system_id, name", name, station, systemId, name)
+}
 
-	// Retry up to 5 times...
-	retrying := 5
-	for retrying > 0 {
-		_, err = eddpDb.Exec("INSERT INTO bodies(system_id, id, name, data) VALUES(?, ?, ?, ?)", systemId, nextId, name, body)
-		if err != nil {
-			// Failed to do it this time, wait for a second to retry
-			time.Sleep(1000 * time.Millisecond)
-			retrying--
-		} else {
-			// Success
-			break
+// InsertWithLocalId inserts a row in to one of the systems, bodies or stations tables, giving it
+// the next local ID.  The ID is allocated and used within a single transaction, and allocation
+// is serialised across the workers, so concurrent inserts cannot collide
+func InsertWithLocalId(table string, columns string, name string, data string, values ...interface{}) error {
+	localIdMutex.Lock()
+	defer localIdMutex.Unlock()
+
+	// Retry up to 5 times, as the database may be busy
+	var err error
+	for retrying := 5; retrying > 0; retrying-- {
+		var nextId int64
+		nextId, err = insertWithLocalId(table, columns, data, values)
+		if err == nil {
+			logging.Info("Created", logging.Fields{"table": table, "name": name, "id": nextId})
+			return nil
 		}
+		// Failed to do it this time, wait for a second to retry
+		time.Sleep(1000 * time.Millisecond)
 	}
 	return err
 }
 
-func UpdateBody(bodyId int64, body string) error {
-	_, err := eddpDb.Exec("UPDATE bodies SET data = ? WHERE id = ?", body, bodyId)
-	return err
+func insertWithLocalId(table string, columns string, data string, values []interface{}) (int64, error) {
+	tx, err := eddpDb.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var nextId int64
+	err = tx.QueryRow(fmt.Sprintf("SELECT COALESCE(min(id) - 1, ?) FROM %s WHERE id <= ?", table), localIdBase, localIdBase).Scan(&nextId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Splice the ID in to the data
+	data = data[:len(data)-1] + ",\"id\":" + strconv.FormatInt(nextId, 10) + "}"
+
+	placeholders := strings.Repeat("?, ", len(values)+1) + "?"
+	args := append(append([]interface{}{nextId}, values...), data)
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s(id, %s, data) VALUES(%s)", table, columns, placeholders), args...)
+	if err != nil {
+		return 0, err
+	}
+	return nextId, tx.Commit()
 }
 
 func UpdateStation(systemId int64, stationId int64, station string) error {
@@ -1354,6 +2745,11 @@ func UpdateStation(systemId int64, stationId int64, station string) error {
 	return err
 }
 
+// fixCoords fixes each of a set of validated co-ordinates
+func fixCoords(starPos []float64) (float64, float64, float64) {
+	return fixCoord(starPos[0]), fixCoord(starPos[1]), fixCoord(starPos[2])
+}
+
 func fixCoord(a float64) float64 {
 	if a < 0 {
 		return float64(int(math.Ceil(a*32-0.5))) / 32
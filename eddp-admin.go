@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"./config"
+	"./importer"
+	"./logging"
+	_ "github.com/mattn/go-sqlite3" // SQLite driver
+)
+
+// Configuration, loaded at startup
+var cfg *config.Config
+
+// Use the files already downloaded rather than fetching them again
+var noDownload bool
+
+// Have eddnlistener swap in the new database once it is built
+var swap bool
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s rebuild|update|swap [flags]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(os.Stderr, "  rebuild  download and import the source's data in to a new database, ready to be swapped in")
+	fmt.Fprintln(os.Stderr, "  update   download the source's data and update the live database in place with what is newer")
+	fmt.Fprintln(os.Stderr, "  swap     have eddnlistener swap in the new database")
+	fmt.Fprintln(os.Stderr)
+	flag.PrintDefaults()
+}
+
+func main() {
+	// The command comes before the flags
+	command := ""
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	flag.Usage = usage
+	flag.BoolVar(&noDownload, "no-download", false, "Import the files already downloaded, rather than fetching them again")
+	flag.BoolVar(&swap, "swap", false, "Have eddnlistener swap in the new database once it is built")
+	var err error
+	cfg, err = config.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", logging.Fields{"error": err})
+	}
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
+	logging.Info("Configuration", logging.Fields{"config": cfg})
+
+	switch command {
+	case "rebuild":
+		err = Rebuild()
+	case "update":
+		err = Update()
+	case "swap":
+		err = Swap()
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		logging.Fatal("Failed", logging.Fields{"command": command, "error": err})
+	}
+}
+
+// Rebuild builds a new database from the source's data, carrying over what the listener has
+// recorded in the live one.  It is built under a temporary name and only renamed to
+// eddp-new.sqlite once it is complete and checked, so a failed rebuild can never be swapped in
+func Rebuild() error {
+	// Find out now rather than after the rebuild if we won't be able to swap
+	if swap {
+		_, err := adminToken()
+		if err != nil {
+			return err
+		}
+	}
+
+	started := time.Now()
+	source := importer.Source(cfg.Import.Source)
+	dir, err := Fetch(source)
+	if err != nil {
+		return err
+	}
+
+	sqliteDir := filepath.Join(cfg.DataDir, "sqlite")
+	err = os.MkdirAll(sqliteDir, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(cfg.HTTP.Root, 0755)
+	if err != nil {
+		return err
+	}
+	partFilename := filepath.Join(sqliteDir, "eddp-new.sqlite.part")
+	err = os.Remove(partFilename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", partFilename)
+	if err != nil {
+		return err
+	}
+	// BEGIN and COMMIT are separate statements, and the carry over uses temporary tables, so
+	// everything must go to the same connection
+	db.SetMaxOpenConns(1)
+	err = build(db, source, dir, started, filepath.Join(sqliteDir, "eddp.sqlite"))
+	closeErr := db.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partFilename)
+		return err
+	}
+
+	err = os.Rename(partFilename, filepath.Join(sqliteDir, "eddp-new.sqlite"))
+	if err != nil {
+		return err
+	}
+	logging.Info("Rebuilt database", logging.Fields{"source": source, "seconds": int(time.Since(started).Seconds())})
+
+	if swap {
+		return Swap()
+	}
+	return nil
+}
+
+func build(db *sql.DB, source importer.Source, dir string, started time.Time, liveFilename string) error {
+	err := importer.StartBuild(db, source, started)
+	if err != nil {
+		return err
+	}
+	err = importer.New(db, source, dir).Run()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(liveFilename); err == nil {
+		logging.Info("Carrying over from the live database", logging.Fields{"file": liveFilename})
+		err = importer.CarryOver(db, liveFilename)
+		if err != nil {
+			return err
+		}
+	}
+	err = importer.Check(db)
+	if err != nil {
+		return err
+	}
+	return importer.FinishBuild(db)
+}
+
+// Update updates the live database in place with what is newer in the source's data, while the
+// servers run.  The database must have been built from the same source, as each has its own IDs
+func Update() error {
+	source := importer.Source(cfg.Import.Source)
+	dir, err := Fetch(source)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(cfg.DataDir, "sqlite", "eddp.sqlite"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// BEGIN and COMMIT are separate statements, so must go to the same connection
+	db.SetMaxOpenConns(1)
+	im := importer.New(db, source, dir)
+	im.Incremental = true
+	return im.Run()
+}
+
+// Fetch downloads and verifies the source's files, returning the directory holding them.  If
+// import.url is a local directory, the files are imported from there without being copied
+func Fetch(source importer.Source) (string, error) {
+	url := cfg.Import.URL
+	if url == "" {
+		url = source.URL()
+	}
+	dir := cfg.Import.Dir
+	if dir == "" {
+		dir = filepath.Join(cfg.DataDir, string(source))
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		dir = url
+	} else if !noDownload {
+		err := importer.Download(url, dir, source.Files())
+		if err != nil {
+			return "", err
+		}
+	}
+	return dir, importer.Verify(url, dir, source.Files())
+}
+
+// adminToken reads the token that eddnlistener wants before it will swap databases
+func adminToken() (string, error) {
+	token, err := cfg.EDDN.AdminToken()
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", errors.New("eddn.admin_token_file must be set to swap databases")
+	}
+	return token, nil
+}
+
+// Swap asks eddnlistener to swap in the new database
+func Swap() error {
+	url := "http://" + cfg.EDDN.AdminAddr + "/swap"
+	token, err := adminToken()
+	if err != nil {
+		return err
+	}
+	logging.Info("Swapping in new database", logging.Fields{"url": url})
+	request, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s %s", url, response.Status, strings.TrimSpace(string(body)))
+	}
+	logging.Info("Swapped in new database")
+	return nil
+}
@@ -1,71 +1,184 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"./config"
-	"github.com/ajays20078/go-http-logger" // Log HTTP requests
-	"github.com/gorilla/mux"               // URL-based routing
-	_ "github.com/mattn/go-sqlite3"        // SQLite driver
-	"github.com/nytimes/gziphandler"       // GZip handler
+	"./logging"
+	"github.com/gorilla/mux"                         // URL-based routing
+	_ "github.com/mattn/go-sqlite3"                  // SQLite driver
+	"github.com/nytimes/gziphandler"                 // GZip handler
+	"github.com/prometheus/client_golang/prometheus" // Metrics
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var version string = "3.3.2"
 
-// Database connections
+// Database connections.  eddp.sqlite is replaced when a rebuild is swapped in, so its
+// connection is obtained through EddpDb
 var eddpDb *sql.DB
+var eddpDbMutex sync.RWMutex
 var profileDb *sql.DB
 var errorDb *sql.DB
 
-var dataDir string = config.GetEnvWithDefault("EDDP_API_DATA_DIR", "./data")
-var httpAddr string = config.GetEnvWithDefault("EDDP_API_HTTP_ADDR", ":8080")
-var httpRoot string = config.GetEnvWithDefault("EDDP_API_HTTP_ROOT", "./data/http")
+// Metrics, served at /metrics
+var metricsRegistry = prometheus.NewRegistry()
+var metrics = promauto.With(metricsRegistry)
+var requestsTotal = metrics.NewCounterVec(prometheus.CounterOpts{
+	Name: "eddpd_http_requests_total",
+	Help: "HTTP requests, by route, method and status code.",
+}, []string{"route", "method", "code"})
+var requestSeconds = metrics.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "eddpd_http_request_duration_seconds",
+	Help:    "Time taken to serve an HTTP request, by route.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"route"})
+var dbQuerySeconds = metrics.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "eddpd_db_query_duration_seconds",
+	Help:    "Time taken by database queries, including reading their results.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"query"})
+
+// Configuration, loaded at startup
+var cfg *config.Config
 
 func main() {
+	var err error
+	cfg, err = config.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", logging.Fields{"error": err})
+	}
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
+	logging.Info("Configuration", logging.Fields{"config": cfg})
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	var err error
-	eddpDb, err = sql.Open("sqlite3", dataDir+"/sqlite/eddp.sqlite")
+	eddpDb, err = sql.Open("sqlite3", cfg.DataDir+"/sqlite/eddp.sqlite")
 	if err != nil {
-		log.Print(err)
+		logging.Error("Failed to open database", logging.Fields{"database": "eddp", "error": err})
 	}
-	errorDb, err = sql.Open("sqlite3", dataDir+"/sqlite/error.sqlite")
+	errorDb, err = sql.Open("sqlite3", cfg.DataDir+"/sqlite/error.sqlite")
 	if err != nil {
-		log.Print(err)
+		logging.Error("Failed to open database", logging.Fields{"database": "error", "error": err})
 	}
-	profileDb, err = sql.Open("sqlite3", dataDir+"/sqlite/profile.sqlite")
+	profileDb, err = sql.Open("sqlite3", cfg.DataDir+"/sqlite/profile.sqlite")
 	if err != nil {
-		log.Print(err)
+		logging.Error("Failed to open database", logging.Fields{"database": "profile", "error": err})
 	}
+	go WatchDatabase()
 
 	r := mux.NewRouter()
 	r.HandleFunc("/version", VersionHandler).Methods("GET")
+	r.HandleFunc("/health", HealthHandler).Methods("GET")
+	r.HandleFunc("/ready", ReadyHandler).Methods("GET")
 	r.HandleFunc("/eddi/version", VersionHandler).Methods("GET")
 	r.HandleFunc("/error", ErrorHandler).Methods("POST")
 	r.HandleFunc("/log", LogHandler).Methods("POST")
 	r.HandleFunc("/profile", ProfileHandler).Methods("POST")
 	// Static JSON files
-	r.PathPrefix("/_").Handler(http.StripPrefix("/_", http.FileServer(http.Dir(httpRoot))))
-	r.PathPrefix("/.").Handler(http.StripPrefix("/", http.FileServer(http.Dir(httpRoot))))
+	r.PathPrefix("/_").Handler(http.StripPrefix("/_", http.FileServer(http.Dir(cfg.HTTP.Root))))
+	r.PathPrefix("/.").Handler(http.StripPrefix("/", http.FileServer(http.Dir(cfg.HTTP.Root))))
+	// System search
+	r.HandleFunc("/systems", SystemsHandler).Methods("GET")
+	// Codex search
+	r.HandleFunc("/codex", CodexHandler).Methods("GET")
 	// Generic database handler
 	r.HandleFunc("/{category}/{item}", DatabaseHandler).Methods("GET")
 
-	http.Handle("/", gziphandler.GzipHandler(r))
-	err = http.ListenAndServe(httpAddr, JsonContent(httpLogger.WriteLog(http.DefaultServeMux, os.Stdout)))
-	if err != nil {
-		log.Print("ListenAndServe: ", err)
+	http.Handle("/", Instrument(r, gziphandler.GzipHandler(r)))
+	http.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: cfg.HTTP.Addr, Handler: JsonContent(http.DefaultServeMux)}
+
+	// On SIGTERM or interrupt stop accepting connections and let in-flight requests finish
+	stopped := make(chan int, 1)
+	terms := make(chan os.Signal, 1)
+	signal.Notify(terms, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-terms
+		logging.Info("Shutting down", logging.Fields{"signal": sig.String()})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logging.Error("Shutdown failed", logging.Fields{"error": err})
+			stopped <- 1
+			return
+		}
+		stopped <- 0
+	}()
+
+	status := 1
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		status = <-stopped
+	} else {
+		logging.Error("HTTP server failed", logging.Fields{"addr": cfg.HTTP.Addr, "error": err})
+	}
+
+	EddpDb().Close()
+	errorDb.Close()
+	profileDb.Close()
+	os.Exit(status)
+}
+
+func EddpDb() *sql.DB {
+	eddpDbMutex.RLock()
+	defer eddpDbMutex.RUnlock()
+	return eddpDb
+}
+
+// How often to check whether eddp.sqlite has been replaced
+const swapCheckInterval = 10 * time.Second
+
+// How long the replaced database stays open, for requests that were already using it
+const swapGracePeriod = time.Minute
+
+// WatchDatabase switches to a new eddp.sqlite when eddnlistener swaps in a rebuilt one.  The
+// old file lives on, renamed or unlinked, until its connections are closed
+func WatchDatabase() {
+	filename := cfg.DataDir + "/sqlite/eddp.sqlite"
+	current, _ := os.Stat(filename)
+	for range time.Tick(swapCheckInterval) {
+		info, err := os.Stat(filename)
+		if err != nil || (current != nil && os.SameFile(info, current)) {
+			continue
+		}
+		db, err := sql.Open("sqlite3", filename)
+		if err != nil {
+			logging.Error("Failed to open database", logging.Fields{"database": "eddp", "error": err})
+			continue
+		}
+		current = info
+
+		eddpDbMutex.Lock()
+		old := eddpDb
+		eddpDb = db
+		eddpDbMutex.Unlock()
+		logging.Info("Switched to new database", logging.Fields{"database": "eddp", "modified_at": info.ModTime().UTC()})
+		if old != nil {
+			time.AfterFunc(swapGracePeriod, func() { old.Close() })
+		}
 	}
 }
 
@@ -73,28 +186,130 @@ func VersionHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, version)
 }
 
+// HealthHandler reports that the server is running
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "{\"status\":\"ok\",\"version\":\""+version+"\"}")
+}
+
+// DatabaseStatus describes one of our databases
+type DatabaseStatus struct {
+	Name                 string           `json:"name"`
+	Ok                   bool             `json:"ok"`
+	Error                string           `json:"error,omitempty"`
+	Size                 int64            `json:"size"`
+	ModifiedAt           *time.Time       `json:"modified_at,omitempty"`
+	SecondsSinceModified int64            `json:"seconds_since_modified"`
+	EstimatedRows        map[string]int64 `json:"estimated_rows,omitempty"`
+}
+
+// How long a database has to answer a readiness check
+const readyTimeout = 2 * time.Second
+
+// ReadyHandler checks that each database can be queried, returning a 503 if any cannot.  As
+// eddnlistener writes to eddp.sqlite as it goes, the time since that was modified is the time
+// since the listener last wrote an update
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	var databases []DatabaseStatus
+	for _, database := range []struct {
+		name   string
+		db     *sql.DB
+		tables []string
+	}{
+		{"eddp", EddpDb(), []string{"systems", "bodies", "stations"}},
+		{"error", errorDb, nil},
+		{"profile", profileDb, nil},
+	} {
+		status := CheckDatabase(database.name, database.db, database.tables)
+		ready = ready && status.Ok
+		databases = append(databases, status)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"ready": ready, "databases": databases})
+	if err != nil {
+		logging.Error("Failed to encode readiness", logging.Fields{"error": err})
+		w.WriteHeader(500)
+		return
+	}
+	if !ready {
+		w.WriteHeader(503)
+	}
+	w.Write(data)
+}
+
+// CheckDatabase checks that a database file exists and answers queries.  A true count of rows
+// takes far too long, so they are estimated from the statistics that a rebuild gathers, which
+// are as of that rebuild; databases without them have no estimate
+func CheckDatabase(name string, db *sql.DB, tables []string) DatabaseStatus {
+	status := DatabaseStatus{Name: name}
+	info, err := os.Stat(cfg.DataDir + "/sqlite/" + name + ".sqlite")
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	modifiedAt := info.ModTime().UTC()
+	status.Size = info.Size()
+	status.ModifiedAt = &modifiedAt
+	status.SecondsSinceModified = int64(time.Since(modifiedAt).Seconds())
+
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+	var one int
+	err = db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	var analysed bool
+	err = db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'sqlite_stat1')").Scan(&analysed)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if analysed && len(tables) > 0 {
+		status.EstimatedRows = make(map[string]int64)
+		for _, table := range tables {
+			// Each row's statistics start with the number of rows in the table
+			var rows int64
+			err = db.QueryRowContext(ctx, "SELECT CAST(stat AS INT) FROM sqlite_stat1 WHERE tbl = ? LIMIT 1", table).Scan(&rows)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				status.Error = err.Error()
+				return status
+			}
+			status.EstimatedRows[table] = rows
+		}
+	}
+	status.Ok = true
+	return status
+}
+
 func ErrorHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
-		log.Print(err)
+		logging.Warn("Failed to read error report", logging.Fields{"error": err})
 	}
 	if err := r.Body.Close(); err != nil {
-		log.Print(err)
+		logging.Warn("Failed to close request body", logging.Fields{"error": err})
 	}
 
+	queryStart := time.Now()
 	_, err = errorDb.Exec("INSERT INTO errors(ipaddr, error) VALUES(?, ?)", r.RemoteAddr, string(body))
+	dbQuerySeconds.WithLabelValues("insert_error").Observe(time.Since(queryStart).Seconds())
 	if err != nil {
-		log.Print(err)
+		logging.Error("Failed to store error report", logging.Fields{"error": err})
 	}
 }
 
 func LogHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576*1024))
 	if err != nil {
-		log.Print(err)
+		logging.Warn("Failed to read log", logging.Fields{"error": err})
 	}
 	if err := r.Body.Close(); err != nil {
-		log.Print(err)
+		logging.Warn("Failed to close request body", logging.Fields{"error": err})
 	}
 
 	regex, _ := regexp.Compile("^[^:]*")
@@ -102,22 +317,24 @@ func LogHandler(w http.ResponseWriter, r *http.Request) {
 
 	err = ioutil.WriteFile("logs/"+ipaddr+"-"+time.Now().Format("20060102T150405"), body, 0644)
 	if err != nil {
-		log.Print(err)
+		logging.Error("Failed to store log", logging.Fields{"error": err})
 	}
 }
 
 func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
-		log.Print(err)
+		logging.Warn("Failed to read profile", logging.Fields{"error": err})
 	}
 	if err := r.Body.Close(); err != nil {
-		log.Print(err)
+		logging.Warn("Failed to close request body", logging.Fields{"error": err})
 	}
 
+	queryStart := time.Now()
 	_, err = profileDb.Exec("INSERT INTO profiles(ipaddr, profile) VALUES(?, ?)", r.RemoteAddr, string(body))
+	dbQuerySeconds.WithLabelValues("insert_profile").Observe(time.Since(queryStart).Seconds())
 	if err != nil {
-		log.Print(err)
+		logging.Error("Failed to store profile", logging.Fields{"error": err})
 	}
 }
 
@@ -136,28 +353,31 @@ func DatabaseHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	category, err := url.QueryUnescape(regex.ReplaceAllString(vars["category"], ""))
 	if err != nil {
-		log.Print(err)
+		logging.Info("Invalid category", logging.Fields{"category": vars["category"], "error": err})
 		w.WriteHeader(500)
 		return
 	}
 	item, err := url.QueryUnescape(vars["item"])
 	if err != nil {
-		log.Print(err)
+		logging.Info("Invalid item", logging.Fields{"item": vars["item"], "error": err})
 		w.WriteHeader(500)
 		return
 	}
 
 	var dataId int
 	var data string
-	err = eddpDb.QueryRow(fmt.Sprintf("SELECT id, data FROM %s WHERE name = ?", category), item).Scan(&dataId, &data)
+	queryStart := time.Now()
+	err = EddpDb().QueryRow(fmt.Sprintf("SELECT id, data FROM %s WHERE name = ?", category), item).Scan(&dataId, &data)
+	dbQuerySeconds.WithLabelValues("fetch_item").Observe(time.Since(queryStart).Seconds())
 	if err != nil {
-		log.Print(err)
+		logging.Debug("Item not found", logging.Fields{"category": category, "item": item, "error": err})
 		w.WriteHeader(404)
 		return
 	}
 	if category == "systems" {
 		var bodies []string
-		rows, err := eddpDb.Query("SELECT data FROM bodies WHERE system_id = ?", dataId)
+		queryStart = time.Now()
+		rows, err := EddpDb().Query("SELECT data FROM bodies WHERE system_id = ?", dataId)
 		if err == nil {
 			defer rows.Close()
 			for rows.Next() {
@@ -166,8 +386,10 @@ func DatabaseHandler(w http.ResponseWriter, r *http.Request) {
 				bodies = append(bodies, bodyData)
 			}
 		}
+		dbQuerySeconds.WithLabelValues("fetch_bodies").Observe(time.Since(queryStart).Seconds())
 		var stations []string
-		rows, err = eddpDb.Query("SELECT data FROM stations WHERE system_id = ?", dataId)
+		queryStart = time.Now()
+		rows, err = EddpDb().Query("SELECT data FROM stations WHERE system_id = ?", dataId)
 		if err == nil {
 			defer rows.Close()
 			for rows.Next() {
@@ -176,6 +398,8 @@ func DatabaseHandler(w http.ResponseWriter, r *http.Request) {
 				stations = append(stations, stationData)
 			}
 		}
+		dbQuerySeconds.WithLabelValues("fetch_stations").Observe(time.Since(queryStart).Seconds())
+		data, _ = AddScanCompleteness(data, len(bodies))
 		// Hack the system string to remove the final close bracket and add in the data we have gathered
 		data = strings.TrimSuffix(data, "}")
 		data = data + ",\"bodies\":[" + strings.Join(bodies, ",") + "],\"stations\":[" + strings.Join(stations, ",") + "]}"
@@ -183,6 +407,205 @@ func DatabaseHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, data)
 }
 
+// Default and maximum search radius, in light years
+const defaultRadius = 50
+const maxRadius = 200
+
+// Maximum number of systems returned by a search
+const maxSearchResults = 1000
+
+// SystemsHandler searches for systems around a point, given either as the name of a
+// system (?near=) or as co-ordinates (?x=&y=&z=).  Results can be restricted to systems
+// which have or have not had all of their bodies scanned with ?fully_scanned=
+func SystemsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	x, y, z, err := SearchOrigin(query)
+	if err != nil {
+		logging.Info("Invalid search origin", logging.Fields{"query": r.URL.RawQuery, "error": err})
+		w.WriteHeader(400)
+		return
+	}
+
+	radius, err := SearchRadius(query)
+	if err != nil {
+		logging.Info("Invalid search radius", logging.Fields{"query": r.URL.RawQuery, "error": err})
+		w.WriteHeader(400)
+		return
+	}
+
+	// Nil matches every system
+	var fullyScannedFilter interface{}
+	if query.Get("fully_scanned") != "" {
+		fullyScanned, err := strconv.ParseBool(query.Get("fully_scanned"))
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		fullyScannedFilter = fullyScanned
+	}
+
+	// The R*Tree finds the systems within the bounding box of the search, and only those within
+	// the radius go on to have their bodies counted; distance is squared.  A system is fully
+	// scanned, as AddScanCompleteness has it, if we know of as many bodies as it has
+	queryStart := time.Now()
+	rows, err := EddpDb().Query("SELECT data, bodies_known, distance FROM (SELECT candidates.data, (SELECT COUNT(*) FROM bodies WHERE bodies.system_id = candidates.id) AS bodies_known, CAST(json_extract(candidates.data, '$.body_count') AS INT) AS body_count, distance FROM (SELECT systems.id, systems.data, (CAST(x AS FLOAT) - ?) * (CAST(x AS FLOAT) - ?) + (CAST(y AS FLOAT) - ?) * (CAST(y AS FLOAT) - ?) + (CAST(z AS FLOAT) - ?) * (CAST(z AS FLOAT) - ?) AS distance FROM systems_rtree JOIN systems ON systems.id = systems_rtree.id WHERE systems_rtree.max_x >= ? AND systems_rtree.min_x <= ? AND systems_rtree.max_y >= ? AND systems_rtree.min_y <= ? AND systems_rtree.max_z >= ? AND systems_rtree.min_z <= ?) AS candidates WHERE distance <= ?) WHERE ? IS NULL OR (COALESCE(body_count, 0) > 0 AND bodies_known >= body_count) = ? ORDER BY distance LIMIT ?",
+		x, x, y, y, z, z, x-radius, x+radius, y-radius, y+radius, z-radius, z+radius, radius*radius, fullyScannedFilter, fullyScannedFilter, maxSearchResults)
+	if err != nil {
+		logging.Error("System search failed", logging.Fields{"error": err})
+		w.WriteHeader(500)
+		return
+	}
+	defer rows.Close()
+
+	var systems []string
+	for rows.Next() {
+		var systemData string
+		var bodiesKnown int
+		var distance float64
+		err = rows.Scan(&systemData, &bodiesKnown, &distance)
+		if err != nil {
+			logging.Error("Failed to read system", logging.Fields{"error": err})
+			continue
+		}
+		systemData, _ = AddScanCompleteness(systemData, bodiesKnown)
+		systems = append(systems, systemData)
+	}
+	dbQuerySeconds.WithLabelValues("search_systems").Observe(time.Since(queryStart).Seconds())
+	io.WriteString(w, "["+strings.Join(systems, ",")+"]")
+}
+
+// CodexHandler searches for codex entries by name (?name=), optionally around a point given
+// in the same way as for SystemsHandler (?near= or ?x=&y=&z=, with ?radius=)
+func CodexHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	name := query.Get("name")
+	near := query.Get("near") != "" || query.Get("x") != ""
+	if name == "" && !near {
+		w.WriteHeader(400)
+		return
+	}
+
+	var rows *sql.Rows
+	var err error
+	var queryStart time.Time
+	if near {
+		var x, y, z, radius float64
+		x, y, z, err = SearchOrigin(query)
+		if err != nil {
+			logging.Info("Invalid search origin", logging.Fields{"query": r.URL.RawQuery, "error": err})
+			w.WriteHeader(400)
+			return
+		}
+		radius, err = SearchRadius(query)
+		if err != nil {
+			logging.Info("Invalid search radius", logging.Fields{"query": r.URL.RawQuery, "error": err})
+			w.WriteHeader(400)
+			return
+		}
+		// As for SystemsHandler, the R*Tree finds the systems within the bounding box
+		queryStart = time.Now()
+		rows, err = EddpDb().Query("SELECT codex.data, (CAST(x AS FLOAT) - ?) * (CAST(x AS FLOAT) - ?) + (CAST(y AS FLOAT) - ?) * (CAST(y AS FLOAT) - ?) + (CAST(z AS FLOAT) - ?) * (CAST(z AS FLOAT) - ?) AS distance FROM systems_rtree JOIN systems ON systems.id = systems_rtree.id JOIN codex ON codex.system_id = systems.id WHERE codex.name LIKE ? AND systems_rtree.max_x >= ? AND systems_rtree.min_x <= ? AND systems_rtree.max_y >= ? AND systems_rtree.min_y <= ? AND systems_rtree.max_z >= ? AND systems_rtree.min_z <= ? AND distance <= ? ORDER BY distance LIMIT ?",
+			x, x, y, y, z, z, "%"+name+"%", x-radius, x+radius, y-radius, y+radius, z-radius, z+radius, radius*radius, maxSearchResults)
+	} else {
+		queryStart = time.Now()
+		rows, err = EddpDb().Query("SELECT data, 0 FROM codex WHERE name LIKE ? LIMIT ?", "%"+name+"%", maxSearchResults)
+	}
+	if err != nil {
+		logging.Error("Codex search failed", logging.Fields{"error": err})
+		w.WriteHeader(500)
+		return
+	}
+	defer rows.Close()
+
+	var entries []string
+	for rows.Next() {
+		var entryData string
+		var distance float64
+		err = rows.Scan(&entryData, &distance)
+		if err != nil {
+			logging.Error("Failed to read codex entry", logging.Fields{"error": err})
+			continue
+		}
+		entries = append(entries, entryData)
+	}
+	dbQuerySeconds.WithLabelValues("search_codex").Observe(time.Since(queryStart).Seconds())
+	io.WriteString(w, "["+strings.Join(entries, ",")+"]")
+}
+
+// SearchRadius obtains the radius of a search from the request parameters
+func SearchRadius(query url.Values) (float64, error) {
+	if query.Get("radius") == "" {
+		return defaultRadius, nil
+	}
+	radius, err := strconv.ParseFloat(query.Get("radius"), 64)
+	if err != nil || radius < 0 || radius > maxRadius {
+		return 0, errors.New("Invalid radius")
+	}
+	return radius, nil
+}
+
+// SearchOrigin obtains the centre of a search from the request parameters
+func SearchOrigin(query url.Values) (float64, float64, float64, error) {
+	if query.Get("near") != "" {
+		var x, y, z float64
+		queryStart := time.Now()
+		err := EddpDb().QueryRow("SELECT CAST(x AS FLOAT), CAST(y AS FLOAT), CAST(z AS FLOAT) FROM systems WHERE name = ? LIMIT 1", query.Get("near")).Scan(&x, &y, &z)
+		dbQuerySeconds.WithLabelValues("fetch_origin").Observe(time.Since(queryStart).Seconds())
+		if err != nil {
+			return 0, 0, 0, errors.New("No such system")
+		}
+		return x, y, z, nil
+	}
+
+	x, err := strconv.ParseFloat(query.Get("x"), 64)
+	if err != nil {
+		return 0, 0, 0, errors.New("Missing or invalid x co-ordinate")
+	}
+	y, err := strconv.ParseFloat(query.Get("y"), 64)
+	if err != nil {
+		return 0, 0, 0, errors.New("Missing or invalid y co-ordinate")
+	}
+	z, err := strconv.ParseFloat(query.Get("z"), 64)
+	if err != nil {
+		return 0, 0, 0, errors.New("Missing or invalid z co-ordinate")
+	}
+	return x, y, z, nil
+}
+
+// AddScanCompleteness adds the number of known bodies and, if we know how many bodies the
+// system has, the fraction of them that we know about.  It also returns whether or not the
+// system is fully scanned; systems with an unknown body count are never fully scanned
+func AddScanCompleteness(data string, bodiesKnown int) (string, bool) {
+	d := json.NewDecoder(strings.NewReader(data))
+	d.UseNumber()
+	var system map[string]interface{}
+	err := d.Decode(&system)
+	if err != nil {
+		logging.Error("Invalid system JSON", logging.Fields{"error": err})
+		return data, false
+	}
+
+	system["bodies_known"] = bodiesKnown
+	fullyScanned := false
+	if bodyCount, ok := system["body_count"].(json.Number); ok {
+		count, err := bodyCount.Int64()
+		if err == nil && count > 0 {
+			system["scan_completeness"] = math.Min(float64(bodiesKnown)/float64(count), 1)
+			fullyScanned = int64(bodiesKnown) >= count
+		}
+	}
+	system["fully_scanned"] = fullyScanned
+
+	updated, err := json.Marshal(system)
+	if err != nil {
+		logging.Error("Failed to encode system", logging.Fields{"error": err})
+		return data, fullyScanned
+	}
+	return string(updated), fullyScanned
+}
+
 // Set content-type for JSON
 func JsonContent(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -190,3 +613,53 @@ func JsonContent(next http.Handler) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	}
 }
+
+// statusRecorder notes the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// methodLabel gives the request method as a metric label.  Clients can send any method they
+// like, so those that we do not serve are counted together
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "POST":
+		return method
+	}
+	return "other"
+}
+
+// Instrument counts, times and logs requests by route and status
+func Instrument(router *mux.Router, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.MatchErr == nil && match.Route != nil {
+			template, err := match.Route.GetPathTemplate()
+			if err == nil {
+				route = template
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		duration := time.Since(start)
+		requestSeconds.WithLabelValues(route).Observe(duration.Seconds())
+		requestsTotal.WithLabelValues(route, methodLabel(r.Method), strconv.Itoa(recorder.status)).Inc()
+		logging.Info("Request", logging.Fields{
+			"remote_addr": r.RemoteAddr,
+			"method":      r.Method,
+			"path":        r.URL.RequestURI(),
+			"route":       route,
+			"status":      recorder.status,
+			"duration_ms": float64(duration.Nanoseconds()) / 1e6,
+			"user_agent":  r.UserAgent(),
+		})
+	}
+}
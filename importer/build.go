@@ -0,0 +1,207 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"../logging"
+)
+
+// StartBuild records when a build started, so that eddnlistener can replay what it has received
+// since, and where the data came from, as each source has its own IDs
+func StartBuild(db *sql.DB, source Source, started time.Time) error {
+	_, err := db.Exec("CREATE TABLE build_info(started_at INT NOT NULL, finished_at INT, source TEXT NOT NULL)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO build_info(started_at, source) VALUES(?, ?)", started.Unix(), string(source))
+	return err
+}
+
+// FinishBuild gathers statistics on the tables and their indices and marks a build as finished;
+// only a finished build can be swapped in.  Besides helping the query planner, the statistics
+// give eddpd's readiness check an estimate of the number of rows in each table
+func FinishBuild(db *sql.DB) error {
+	logging.Info("Analysing database")
+	_, err := db.Exec("ANALYZE")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE build_info SET finished_at = ?", time.Now().Unix())
+	return err
+}
+
+// CarryOver copies what the listener has recorded in the old database that is not part of the
+// imported data.  Systems, bodies and stations that the listener discovered have IDs from
+// localIdBase downwards; those that the source now knows about are recorded in id_map against
+// its IDs, and the rest keep their local IDs.  What the listener records in upstream systems is
+// copied on to them too.  Every old system is matched to a new one by name and co-ordinates,
+// and everything in it follows, so the source may differ from the one that the old database was
+// built from.  The temporary tables are per connection, so db must have only the one
+func CarryOver(db *sql.DB, oldFilename string) (err error) {
+	_, err = db.Exec("ATTACH DATABASE ? AS old", oldFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, detachErr := db.Exec("DETACH DATABASE old")
+		if err == nil {
+			err = detachErr
+		}
+	}()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS id_map(kind TEXT NOT NULL, local_id INT NOT NULL, upstream_id INT NOT NULL)")
+	if err != nil {
+		return err
+	}
+	// Mappings made before are kept, so that anything holding an old local ID can still find
+	// what it became
+	exists, err := oldTableExists(db, "id_map")
+	if err != nil {
+		return err
+	}
+	if exists {
+		_, err = db.Exec("INSERT INTO id_map(kind, local_id, upstream_id) SELECT kind, local_id, upstream_id FROM old.id_map")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`
+INSERT INTO id_map(kind, local_id, upstream_id)
+	SELECT 'system', s.id, systems.id
+	FROM old.systems s
+	JOIN systems ON systems.name = s.name AND CAST(systems.x AS FLOAT) = CAST(s.x AS FLOAT) AND CAST(systems.y AS FLOAT) = CAST(s.y AS FLOAT) AND CAST(systems.z AS FLOAT) = CAST(s.z AS FLOAT)
+	WHERE s.id <= %[1]d;
+INSERT INTO systems(id, x, y, z, name, data)
+	SELECT s.id, s.x, s.y, s.z, s.name, s.data
+	FROM old.systems s
+	WHERE s.id <= %[1]d AND s.id NOT IN (SELECT local_id FROM id_map WHERE kind = 'system');
+
+CREATE TEMP TABLE system_map AS
+	SELECT s.id AS old_id, MIN(systems.id) AS new_id
+	FROM old.systems s
+	JOIN systems ON systems.name = s.name AND CAST(systems.x AS FLOAT) = CAST(s.x AS FLOAT) AND CAST(systems.y AS FLOAT) = CAST(s.y AS FLOAT) AND CAST(systems.z AS FLOAT) = CAST(s.z AS FLOAT)
+	GROUP BY s.id;
+CREATE INDEX temp.system_map_idx1 ON system_map(old_id);
+CREATE INDEX temp.system_map_idx2 ON system_map(new_id);
+
+UPDATE systems SET data = json_patch(data, (SELECT %[2]s FROM system_map m JOIN old.systems s ON s.id = m.old_id WHERE m.new_id = systems.id LIMIT 1))
+	WHERE id > %[1]d AND id IN (SELECT new_id FROM system_map);
+
+CREATE TEMP TABLE old_bodies AS
+	SELECT b.id, b.name, b.data, m.new_id AS system_id
+	FROM old.bodies b
+	JOIN system_map m ON m.old_id = b.system_id
+	WHERE b.id <= %[1]d;
+INSERT INTO id_map(kind, local_id, upstream_id)
+	SELECT 'body', b.id, bodies.id
+	FROM old_bodies b
+	JOIN bodies ON bodies.system_id = b.system_id AND bodies.name = b.name;
+INSERT INTO bodies(id, system_id, name, data)
+	SELECT b.id, b.system_id, b.name, json_set(b.data, '$.system_id', b.system_id)
+	FROM old_bodies b
+	WHERE b.id NOT IN (SELECT local_id FROM id_map WHERE kind = 'body');
+DROP TABLE old_bodies;
+
+CREATE TEMP TABLE old_stations AS
+	SELECT st.id, st.name, st.data, m.new_id AS system_id
+	FROM old.stations st
+	JOIN system_map m ON m.old_id = st.system_id
+	WHERE st.id <= %[1]d;
+INSERT INTO id_map(kind, local_id, upstream_id)
+	SELECT 'station', st.id, stations.id
+	FROM old_stations st
+	JOIN stations ON stations.system_id = st.system_id AND stations.name = st.name;
+INSERT INTO stations(id, system_id, name, data)
+	SELECT st.id, st.system_id, st.name, json_set(st.data, '$.system_id', st.system_id)
+	FROM old_stations st
+	WHERE st.id NOT IN (SELECT local_id FROM id_map WHERE kind = 'station');
+DROP TABLE old_stations;
+
+CREATE INDEX IF NOT EXISTS id_map_idx1 ON id_map(kind, local_id);
+
+CREATE TABLE IF NOT EXISTS codex(id INTEGER PRIMARY KEY, system_id INT NOT NULL, entry_id INT NOT NULL, body_name TEXT COLLATE NOCASE NOT NULL, name TEXT COLLATE NOCASE NOT NULL, data TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS codex_idx1 ON codex(system_id);
+CREATE INDEX IF NOT EXISTS codex_idx2 ON codex(name);
+CREATE UNIQUE INDEX IF NOT EXISTS codex_idx3 ON codex(system_id, entry_id, body_name);`, localIdBase, listenerSystemKeys("s.data")))
+	if err != nil {
+		return err
+	}
+
+	// The listener creates the codex table when it first opens a database.  Old systems can map
+	// to the same new one, and old databases can hold duplicates, so only the latest of each
+	// entry is kept
+	exists, err = oldTableExists(db, "codex")
+	if err != nil {
+		return err
+	}
+	if exists {
+		_, err = db.Exec(`
+INSERT INTO codex(system_id, entry_id, body_name, name, data)
+	SELECT systems.id, c.entry_id, c.body_name, c.name, json_remove(json_set(c.data, '$.system_id', systems.id), '$.body_id')
+	FROM old.codex c
+	JOIN system_map m ON m.old_id = c.system_id
+	JOIN systems ON systems.id = m.new_id
+	ORDER BY c.id DESC
+	ON CONFLICT(system_id, entry_id, body_name) DO NOTHING`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec("DROP TABLE system_map")
+	if err != nil {
+		return err
+	}
+
+	var systems, bodies, stations int
+	err = db.QueryRow("SELECT (SELECT COUNT(*) FROM systems WHERE id <= ?), (SELECT COUNT(*) FROM bodies WHERE id <= ?), (SELECT COUNT(*) FROM stations WHERE id <= ?)", localIdBase, localIdBase, localIdBase).Scan(&systems, &bodies, &stations)
+	if err != nil {
+		return err
+	}
+	logging.Info("Carried over", logging.Fields{"systems": systems, "bodies": bodies, "stations": stations})
+	return nil
+}
+
+func oldTableExists(db *sql.DB, table string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM old.sqlite_master WHERE type = 'table' AND name = ?)", table).Scan(&exists)
+	return exists, err
+}
+
+// Check makes sure that a newly built database is sound before it can be swapped in.  Bodies
+// and stations whose systems are missing are only warned about, as the sources have a few
+func Check(db *sql.DB) error {
+	logging.Info("Checking database")
+	var result string
+	err := db.QueryRow("PRAGMA quick_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New("Database is corrupt: " + result)
+	}
+
+	var systems, bodies, stations int
+	err = db.QueryRow("SELECT (SELECT COUNT(*) FROM systems), (SELECT COUNT(*) FROM bodies), (SELECT COUNT(*) FROM stations)").Scan(&systems, &bodies, &stations)
+	if err != nil {
+		return err
+	}
+	if systems == 0 {
+		return errors.New("No systems were imported")
+	}
+
+	var orphanBodies, orphanStations int
+	err = db.QueryRow("SELECT (SELECT COUNT(*) FROM bodies WHERE NOT EXISTS (SELECT 1 FROM systems WHERE systems.id = bodies.system_id)), (SELECT COUNT(*) FROM stations WHERE NOT EXISTS (SELECT 1 FROM systems WHERE systems.id = stations.system_id))").Scan(&orphanBodies, &orphanStations)
+	if err != nil {
+		return err
+	}
+	if orphanBodies > 0 || orphanStations > 0 {
+		logging.Warn("Bodies or stations without a system", logging.Fields{"bodies": orphanBodies, "stations": orphanStations})
+	}
+	logging.Info("Checked database", logging.Fields{"systems": systems, "bodies": bodies, "stations": stations})
+	return nil
+}
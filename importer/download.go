@@ -0,0 +1,184 @@
+package importer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"../logging"
+)
+
+// How often a download reports its progress
+const downloadProgressInterval = 30 * time.Second
+
+// Download fetches each of the files from baseURL in to dir.  Each is written alongside under
+// a temporary name and only renamed once it is complete, so a failed download never replaces a
+// good file
+func Download(baseURL string, dir string, files []string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	for _, name := range files {
+		err = download(baseURL+name, filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func download(url string, filename string) error {
+	logging.Info("Downloading", logging.Fields{"url": url})
+	started := time.Now()
+	response, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, response.Status)
+	}
+
+	partFilename := filename + ".part"
+	file, err := os.Create(partFilename)
+	if err != nil {
+		return err
+	}
+	progress := &progressWriter{url: url, total: response.ContentLength, last: time.Now()}
+	written, err := io.Copy(file, io.TeeReader(response.Body, progress))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && response.ContentLength >= 0 && written != response.ContentLength {
+		err = fmt.Errorf("%s: received %d of %d bytes", url, written, response.ContentLength)
+	}
+	if err != nil {
+		os.Remove(partFilename)
+		return err
+	}
+
+	err = os.Rename(partFilename, filename)
+	if err != nil {
+		return err
+	}
+	logging.Info("Downloaded", logging.Fields{"url": url, "bytes": written, "seconds": int(time.Since(started).Seconds())})
+	return nil
+}
+
+// progressWriter counts the bytes downloaded, reporting them every so often
+type progressWriter struct {
+	url     string
+	total   int64
+	written int64
+	last    time.Time
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	p.written += int64(len(data))
+	if time.Since(p.last) >= downloadProgressInterval {
+		p.last = time.Now()
+		fields := logging.Fields{"url": p.url, "bytes": p.written}
+		if p.total > 0 {
+			fields["percent"] = p.written * 100 / p.total
+		}
+		logging.Info("Downloading", fields)
+	}
+	return len(data), nil
+}
+
+// Verify checks that each of the files in dir is there, is as long as the copy at baseURL, and
+// starts as its source's files should.  None of the sources publish checksums, so the length is
+// all that can be checked before importing; gzipped dumps are checked against their CRCs as they
+// are imported.  If baseURL isn't a URL then the files are local, and only their start is checked
+func Verify(baseURL string, dir string, files []string) error {
+	remote := strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://")
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	for _, name := range files {
+		logging.Info("Verifying", logging.Fields{"file": name})
+		filename := filepath.Join(dir, name)
+		var err error
+		if remote {
+			err = verifyLength(baseURL+name, filename)
+		}
+		if err == nil {
+			err = verify(filename)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// verifyLength checks that a file is as long as the server says that it should be
+func verifyLength(url string, filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	response, err := http.Head(url)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, response.Status)
+	}
+	if response.ContentLength >= 0 && info.Size() != response.ContentLength {
+		return fmt.Errorf("%d bytes, but %s has %d", info.Size(), url, response.ContentLength)
+	}
+	return nil
+}
+
+func verify(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	gzipped := strings.HasSuffix(filename, ".gz")
+	if gzipped {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	buffered := bufio.NewReader(reader)
+
+	// JSON files start with an array or an object, and CSV files with a header
+	first, err := buffered.ReadByte()
+	if err == io.EOF {
+		return errors.New("empty file")
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasSuffix(filename, ".csv"):
+		header, err := buffered.ReadString('\n')
+		if err != nil || !strings.Contains(header, ",") {
+			return errors.New("no CSV header")
+		}
+	case first != '[' && first != '{':
+		return errors.New("not JSON")
+	}
+	return nil
+}
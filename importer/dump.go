@@ -0,0 +1,234 @@
+package importer
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"../logging"
+)
+
+// dumpBody is a body in a Spansh or EDSM dump, which describe bodies in the same way
+type dumpBody struct {
+	// EDSM's bodies are in a dump of their own, so carry their IDs
+	Id       int64 `json:"id"`
+	SystemId int64 `json:"systemId"`
+	// The body's ID within its system, as the game numbers them
+	BodyId *int64 `json:"bodyId"`
+
+	Name                          string             `json:"name"`
+	Type                          string             `json:"type"`
+	SubType                       string             `json:"subType"`
+	DistanceToArrival             *float64           `json:"distanceToArrival"`
+	MainStar                      bool               `json:"mainStar"`
+	IsMainStar                    bool               `json:"isMainStar"`
+	Age                           *float64           `json:"age"`
+	SpectralClass                 string             `json:"spectralClass"`
+	Luminosity                    string             `json:"luminosity"`
+	AbsoluteMagnitude             *float64           `json:"absoluteMagnitude"`
+	SolarMasses                   *float64           `json:"solarMasses"`
+	SolarRadius                   *float64           `json:"solarRadius"`
+	SurfaceTemperature            *float64           `json:"surfaceTemperature"`
+	IsLandable                    bool               `json:"isLandable"`
+	Gravity                       *float64           `json:"gravity"`
+	EarthMasses                   *float64           `json:"earthMasses"`
+	Radius                        *float64           `json:"radius"`
+	SurfacePressure               *float64           `json:"surfacePressure"`
+	VolcanismType                 string             `json:"volcanismType"`
+	AtmosphereType                string             `json:"atmosphereType"`
+	TerraformingState             string             `json:"terraformingState"`
+	ReserveLevel                  string             `json:"reserveLevel"`
+	OrbitalPeriod                 *float64           `json:"orbitalPeriod"`
+	SemiMajorAxis                 *float64           `json:"semiMajorAxis"`
+	OrbitalEccentricity           *float64           `json:"orbitalEccentricity"`
+	OrbitalInclination            *float64           `json:"orbitalInclination"`
+	ArgOfPeriapsis                *float64           `json:"argOfPeriapsis"`
+	RotationalPeriod              *float64           `json:"rotationalPeriod"`
+	RotationalPeriodTidallyLocked bool               `json:"rotationalPeriodTidallyLocked"`
+	AxialTilt                     *float64           `json:"axialTilt"`
+	AtmosphereComposition         map[string]float64 `json:"atmosphereComposition"`
+	SolidComposition              map[string]float64 `json:"solidComposition"`
+	Materials                     map[string]float64 `json:"materials"`
+	Rings                         []struct {
+		Name        string   `json:"name"`
+		Type        string   `json:"type"`
+		Mass        *float64 `json:"mass"`
+		InnerRadius *float64 `json:"innerRadius"`
+		OuterRadius *float64 `json:"outerRadius"`
+	} `json:"rings"`
+	UpdateTime string `json:"updateTime"`
+
+	// Spansh's bodies hold the stations on them
+	Stations []spanshStation `json:"stations"`
+}
+
+// bodyData is a body in the shape that the EDDB import produces
+func bodyData(id int64, systemId int64, dump *dumpBody) (string, int64, error) {
+	body := make(map[string]interface{})
+	body["id"] = id
+	body["system_id"] = systemId
+	body["name"] = dump.Name
+	if dump.Type == "Star" {
+		body["group_id"] = 2
+		body["group_name"] = "Star"
+		body["is_main_star"] = dump.MainStar || dump.IsMainStar
+	} else {
+		body["group_id"] = 6
+		body["group_name"] = "Planet"
+	}
+	setString(body, "type_name", dump.SubType)
+	setFloat(body, "distance_to_arrival", dump.DistanceToArrival)
+	setFloat(body, "age", dump.Age)
+	setString(body, "spectral_class", dump.SpectralClass)
+	setString(body, "luminosity_class", dump.Luminosity)
+	setFloat(body, "absolute_magnitude", dump.AbsoluteMagnitude)
+	setFloat(body, "solar_masses", dump.SolarMasses)
+	setFloat(body, "solar_radius", dump.SolarRadius)
+	setFloat(body, "surface_temperature", dump.SurfaceTemperature)
+	body["is_landable"] = dump.IsLandable
+	setFloat(body, "gravity", dump.Gravity)
+	setFloat(body, "earth_masses", dump.EarthMasses)
+	setFloat(body, "radius", dump.Radius)
+	setFloat(body, "surface_pressure", dump.SurfacePressure)
+	setString(body, "volcanism_type_name", dump.VolcanismType)
+	setString(body, "atmosphere_type_name", dump.AtmosphereType)
+	setString(body, "terraforming_state_name", dump.TerraformingState)
+	setString(body, "reserve_type_name", dump.ReserveLevel)
+	setFloat(body, "orbital_period", dump.OrbitalPeriod)
+	setFloat(body, "semi_major_axis", dump.SemiMajorAxis)
+	setFloat(body, "orbital_eccentricity", dump.OrbitalEccentricity)
+	setFloat(body, "orbital_inclination", dump.OrbitalInclination)
+	setFloat(body, "arg_of_periapsis", dump.ArgOfPeriapsis)
+	setFloat(body, "rotational_period", dump.RotationalPeriod)
+	body["is_rotational_period_tidally_locked"] = dump.RotationalPeriodTidallyLocked
+	setFloat(body, "axis_tilt", dump.AxialTilt)
+	setShares(body, "atmosphere_composition", "atmosphere_component_name", dump.AtmosphereComposition)
+	setShares(body, "solid_composition", "solid_component_name", dump.SolidComposition)
+	setShares(body, "materials", "material_name", dump.Materials)
+	if len(dump.Rings) > 0 {
+		rings := make([]map[string]interface{}, len(dump.Rings))
+		for i, dumpRing := range dump.Rings {
+			ring := make(map[string]interface{})
+			ring["name"] = dumpRing.Name
+			setString(ring, "ring_type_name", dumpRing.Type)
+			setFloat(ring, "ring_mass", dumpRing.Mass)
+			setFloat(ring, "ring_inner_radius", dumpRing.InnerRadius)
+			setFloat(ring, "ring_outer_radius", dumpRing.OuterRadius)
+			rings[i] = ring
+		}
+		body["rings"] = rings
+	}
+	updatedAt := setTime(body, "updated_at", dump.UpdateTime)
+
+	data, err := json.Marshal(body)
+	return string(data), updatedAt, err
+}
+
+// readDump runs each element of a gzipped dump through the given function.  The dumps are JSON
+// arrays far too large to hold in memory, so they are decoded an element at a time.  The dump
+// is read through to its end, where gzip checks it against its CRC, before the last of it is
+// committed
+func (im *Import) readDump(name string, element func(d *json.Decoder) error) error {
+	file, err := os.Open(filepath.Join(im.Dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	defer reader.Close()
+
+	logging.Info("Importing", logging.Fields{"file": name})
+	err = im.begin()
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(reader)
+	_, err = d.Token()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for d.More() {
+		err = element(d)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	_, err = d.Token()
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	_, err = io.Copy(ioutil.Discard, io.MultiReader(d.Buffered(), reader))
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return im.commit()
+}
+
+// EDDB leaves out values that it doesn't know, so we do the same
+
+func setString(data map[string]interface{}, key string, value string) {
+	if value != "" {
+		data[key] = value
+	}
+}
+
+func setFloat(data map[string]interface{}, key string, value *float64) {
+	if value != nil {
+		data[key] = *value
+	}
+}
+
+// setShares turns a dump's map of percentages in to EDDB's list of shares
+func setShares(data map[string]interface{}, key string, nameKey string, shares map[string]float64) {
+	if len(shares) == 0 {
+		return
+	}
+	var names []string
+	for name := range shares {
+		names = append(names, name)
+	}
+	// Largest share first, as EDDB has them
+	sort.Slice(names, func(i, j int) bool {
+		if shares[names[i]] != shares[names[j]] {
+			return shares[names[i]] > shares[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	list := make([]map[string]interface{}, len(names))
+	for i, name := range names {
+		list[i] = map[string]interface{}{nameKey: name, "share": shares[name]}
+	}
+	data[key] = list
+}
+
+// Spansh times look like "2023-01-31 12:34:56+00" and EDSM's like "2019-03-31 09:07:44" in
+// UTC
+var timeLayouts = []string{"2006-01-02 15:04:05-07", "2006-01-02 15:04:05"}
+
+// setTime sets a Unix time, which is what we keep, returning it
+func setTime(data map[string]interface{}, key string, value string) int64 {
+	if value == "" {
+		return 0
+	}
+	var err error
+	for _, layout := range timeLayouts {
+		var t time.Time
+		t, err = time.Parse(layout, strings.TrimSpace(value))
+		if err == nil {
+			data[key] = t.Unix()
+			return t.Unix()
+		}
+	}
+	logging.Warn("Invalid time", logging.Fields{"time": value, "error": err})
+	return 0
+}
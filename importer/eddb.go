@@ -0,0 +1,512 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"../logging"
+)
+
+func (im *Import) importEDDB() error {
+	err := im.importEDDBSystems()
+	if err != nil {
+		return err
+	}
+	err = im.importEDDBStations()
+	if err != nil {
+		return err
+	}
+	return im.importEDDBBodies()
+}
+
+// openCSV opens one of EDDB's CSV files, skipping the header
+func (im *Import) openCSV(name string) (*os.File, *csv.Reader, error) {
+	file, err := os.Open(filepath.Join(im.Dir, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := csv.NewReader(file)
+	_, err = reader.Read()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return file, reader, nil
+}
+
+// readCSV reads the next line of a CSV file, returning nil at the end
+func readCSV(name string, reader *csv.Reader) ([]string, error) {
+	line, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return line, nil
+}
+
+func (im *Import) importEDDBSystems() error {
+	file, reader, err := im.openCSV("systems.csv")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = im.begin()
+	if err != nil {
+		return err
+	}
+	// Work through the file one line at a time
+	for {
+		line, err := readCSV("systems.csv", reader)
+		if err != nil {
+			return err
+		}
+		if line == nil {
+			break
+		}
+		var buffer bytes.Buffer
+
+		buffer.WriteString("{")
+
+		if line[0] == "" {
+			logging.Warn("Line without ID")
+			continue
+		}
+		id := line[0]
+		buffer.WriteString("\"id\":")
+		buffer.WriteString(id)
+
+		if line[2] == "" {
+			logging.Warn("Line without name")
+			continue
+		}
+		name := line[2]
+		buffer.WriteString(",\"name\":\"")
+		buffer.WriteString(name)
+		buffer.WriteString("\"")
+
+		if line[3] == "" {
+			logging.Warn("Line without X co-ordinate")
+			continue
+		}
+		buffer.WriteString(",\"x\":")
+		buffer.WriteString(line[3])
+		x := line[3]
+
+		if line[4] == "" {
+			logging.Warn("Line without Y co-ordinate")
+			continue
+		}
+		buffer.WriteString(",\"y\":")
+		buffer.WriteString(line[4])
+		y := line[4]
+
+		if line[5] == "" {
+			logging.Warn("Line without Z co-ordinate")
+			continue
+		}
+		buffer.WriteString(",\"z\":")
+		buffer.WriteString(line[5])
+		z := line[5]
+
+		if line[6] != "" {
+			buffer.WriteString(",\"population\":")
+			buffer.WriteString(line[6])
+		}
+
+		if line[7] == "1" {
+			buffer.WriteString(",\"is_populated\":true")
+		} else {
+			buffer.WriteString(",\"is_populated\":false")
+		}
+
+		if line[9] != "" {
+			buffer.WriteString(",\"government\":\"")
+			buffer.WriteString(line[9])
+			buffer.WriteString("\"")
+		}
+
+		if line[11] != "" {
+			buffer.WriteString(",\"allegiance\":\"")
+			buffer.WriteString(line[11])
+			buffer.WriteString("\"")
+		}
+
+		if line[13] != "" {
+			buffer.WriteString(",\"state\":\"")
+			buffer.WriteString(line[13])
+			buffer.WriteString("\"")
+		}
+
+		if line[15] != "" {
+			buffer.WriteString(",\"security\":\"")
+			buffer.WriteString(line[15])
+			buffer.WriteString("\"")
+		}
+
+		if line[17] != "" {
+			buffer.WriteString(",\"primary_economy\":\"")
+			buffer.WriteString(line[17])
+			buffer.WriteString("\"")
+		}
+
+		if line[18] != "" {
+			buffer.WriteString(",\"power\":\"")
+			buffer.WriteString(line[18])
+			buffer.WriteString("\"")
+		}
+
+		if line[19] != "" {
+			buffer.WriteString(",\"power_state\":\"")
+			buffer.WriteString(line[19])
+			buffer.WriteString("\"")
+		}
+
+		if line[22] != "" {
+			buffer.WriteString(",\"updated_at\":")
+			buffer.WriteString(line[22])
+		}
+
+		if line[25] != "" {
+			buffer.WriteString(",\"faction\":\"")
+			buffer.WriteString(line[25])
+			buffer.WriteString("\"")
+		}
+
+		if line[27] != "" {
+			buffer.WriteString(",\"reserve_type\":\"")
+			buffer.WriteString(line[27])
+			buffer.WriteString("\"")
+		}
+
+		buffer.WriteString("}")
+
+		updatedAt, _ := strconv.ParseInt(line[22], 10, 64)
+		err = im.storeSystem(id, x, y, z, name, buffer.String(), updatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return im.commit()
+}
+
+func (im *Import) importEDDBStations() error {
+	// Import the commodities locally
+	commoditiesFile, err := ioutil.ReadFile(filepath.Join(im.Dir, "commodities.json"))
+	if err != nil {
+		return err
+	}
+	var commoditiesDefinitions []map[string]interface{}
+	err = json.Unmarshal(commoditiesFile, &commoditiesDefinitions)
+	if err != nil {
+		return fmt.Errorf("commodities.json: %v", err)
+	}
+	var commodities map[int]string
+	commodities = make(map[int]string)
+	for _, element := range commoditiesDefinitions {
+		commodities[int(element["id"].(float64))] = element["name"].(string)
+	}
+
+	// Fetch the market listings
+	listingsFile, reader, err := im.openCSV("listings.csv")
+	if err != nil {
+		return err
+	}
+	defer listingsFile.Close()
+
+	var m map[string]bytes.Buffer
+	m = make(map[string]bytes.Buffer)
+
+	// Work through the file one line at a time
+	for {
+		line, err := readCSV("listings.csv", reader)
+		if err != nil {
+			return err
+		}
+		if line == nil {
+			break
+		}
+		if line[1] == "" {
+			logging.Warn("Line without station ID")
+			continue
+		}
+		stationid := line[1]
+
+		if line[2] == "" {
+			logging.Warn("Line without commodity ID")
+			continue
+		}
+		commodityid, err := strconv.Atoi(line[2])
+
+		if line[3] == "" {
+			logging.Warn("Line without supply")
+			continue
+		}
+		supply, err := strconv.Atoi(line[3])
+
+		if line[4] == "" {
+			logging.Warn("Line without buy price")
+			continue
+		}
+		buyprice := line[4]
+
+		if line[5] == "" {
+			logging.Warn("Line without sell price")
+			continue
+		}
+		sellprice := line[5]
+
+		if line[6] == "" {
+			logging.Warn("Line without demand")
+			continue
+		}
+		demand, err := strconv.Atoi(line[6])
+		if err != nil {
+			logging.Warn("Line with invalid demand")
+			continue
+		}
+
+		buffer, continuation := m[stationid]
+		if continuation {
+			// Continuation
+			buffer.WriteString(",")
+		} else {
+			// New entry
+			buffer.WriteString("[")
+		}
+
+		buffer.WriteString("{\"id\":")
+		buffer.WriteString(strconv.Itoa(commodityid))
+		buffer.WriteString(",")
+
+		buffer.WriteString("\"name\":\"")
+		buffer.WriteString(commodities[commodityid])
+		buffer.WriteString("\"")
+
+		if supply > 0 {
+			buffer.WriteString(",\"supply\":")
+			buffer.WriteString(strconv.Itoa(supply))
+			buffer.WriteString(",\"buy_price\":")
+			buffer.WriteString(buyprice)
+		}
+
+		if demand > 0 {
+			buffer.WriteString(",\"demand\":")
+			buffer.WriteString(strconv.Itoa(demand))
+			buffer.WriteString(",\"sell_price\":")
+			buffer.WriteString(sellprice)
+		}
+
+		buffer.WriteString("}")
+		m[stationid] = buffer
+	}
+
+	// Import the factions locally
+	factionsFile, reader, err := im.openCSV("factions.csv")
+	if err != nil {
+		return err
+	}
+	defer factionsFile.Close()
+
+	var factions map[int]string
+	factions = make(map[int]string)
+
+	// Work through the file one line at a time
+	for {
+		line, err := readCSV("factions.csv", reader)
+		if err != nil {
+			return err
+		}
+		if line == nil {
+			break
+		}
+		if line[0] == "" {
+			logging.Warn("Line without faction ID")
+			continue
+		}
+		factionid, err := strconv.Atoi(line[0])
+		if err != nil {
+			return fmt.Errorf("factions.csv: %v", err)
+		}
+
+		if line[1] == "" {
+			logging.Warn("Line without faction name")
+			continue
+		}
+		factionname := line[1]
+		factions[factionid] = factionname
+	}
+
+	// Work through the stations file
+	file, err := os.Open(filepath.Join(im.Dir, "stations.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = im.begin()
+	if err != nil {
+		return err
+	}
+	// Work through the file one line at a time
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		data := scanner.Text()
+
+		d := json.NewDecoder(strings.NewReader(data))
+		d.UseNumber()
+		var station map[string]interface{}
+		err = d.Decode(&station)
+		if err != nil {
+			return fmt.Errorf("stations.jsonl: %v", err)
+		}
+
+		systemid, err := station["system_id"].(json.Number).Int64()
+		if err != nil {
+			return fmt.Errorf("stations.jsonl: %v", err)
+		}
+		stationid, err := station["id"].(json.Number).Int64()
+		if err != nil {
+			return fmt.Errorf("stations.jsonl: %v", err)
+		}
+
+		// Remove stuff we don't want.
+		// In general these are either foreign IDs or items that we can't keep up-to-date automatically
+		delete(station, "government_id")
+		delete(station, "allegiance_id")
+		delete(station, "state_id")
+		delete(station, "type_id")
+		delete(station, "import_commodities")
+		delete(station, "export_commodities")
+		delete(station, "prohibited_commodities")
+		delete(station, "settlement_size_id")
+		delete(station, "settlement_security_id")
+		delete(station, "body_id")
+		if station["controlling_minor_faction_id"] != nil {
+			factionid, err := station["controlling_minor_faction_id"].(json.Number).Int64()
+			if err != nil {
+				return fmt.Errorf("stations.jsonl: %v", err)
+			}
+			station["controlling_faction"] = factions[int(factionid)]
+			delete(station, "controlling_minor_faction_id")
+		}
+		if station["economies"] != nil && len(station["economies"].([]interface{})) > 0 {
+			station["primary_economy"] = station["economies"].([]interface{})[0].(string)
+		}
+		delete(station, "economies")
+
+		updatedData, err := json.Marshal(station)
+		if err != nil {
+			return err
+		}
+		data = string(updatedData)
+
+		stationCommodities, stationCommoditiesExists := m[strconv.Itoa(int(stationid))]
+		if stationCommoditiesExists {
+			// Patch in the commodities
+			data = data[:len(data)-1]
+			data = data + ",\"commodities\":"
+			data = data + stationCommodities.String()
+			data = data + "]}"
+		}
+
+		err = im.storeStation(stationid, systemid, station["name"].(string), data, latestUpdate(station))
+		if err != nil {
+			return err
+		}
+	}
+	if scanner.Err() != nil {
+		return fmt.Errorf("stations.jsonl: %v", scanner.Err())
+	}
+	return im.commit()
+}
+
+// latestUpdate is the most recent of the times at which a station, its market and its
+// outfitting were updated
+func latestUpdate(station map[string]interface{}) int64 {
+	var latest int64
+	for _, key := range []string{"updated_at", "market_updated_at", "outfitting_updated_at"} {
+		value, _ := station[key].(json.Number)
+		updatedAt, _ := value.Int64()
+		if updatedAt > latest {
+			latest = updatedAt
+		}
+	}
+	return latest
+}
+
+func (im *Import) importEDDBBodies() error {
+	file, err := os.Open(filepath.Join(im.Dir, "bodies.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = im.begin()
+	if err != nil {
+		return err
+	}
+	// Work through the file one line at a time
+	scanner := bufio.NewScanner(file)
+	// Bodies with many rings and materials make for long lines
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var body map[string]interface{}
+
+		// Set up a decoder that leaves numbers alone
+		d := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		d.UseNumber()
+
+		err := d.Decode(&body)
+		if err != nil {
+			return fmt.Errorf("bodies.jsonl: Invalid body JSON: %v", err)
+		}
+		for k, v := range body {
+			if v == nil {
+				delete(body, k)
+			} else {
+				switch vv := v.(type) {
+				case []interface{}:
+					if len(vv) == 0 {
+						delete(body, k)
+					}
+				}
+			}
+
+		}
+		munged, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		bodyId, err := strconv.ParseUint(string(body["id"].(json.Number)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bodies.jsonl: %v", err)
+		}
+		systemId, err := strconv.ParseUint(string(body["system_id"].(json.Number)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bodies.jsonl: %v", err)
+		}
+		updatedAt, _ := body["updated_at"].(json.Number)
+		updatedAtSecs, _ := updatedAt.Int64()
+		err = im.storeBody(bodyId, systemId, body["name"].(string), string(munged), updatedAtSecs)
+		if err != nil {
+			return err
+		}
+	}
+	if scanner.Err() != nil {
+		return fmt.Errorf("bodies.jsonl: %v", scanner.Err())
+	}
+	return im.commit()
+}
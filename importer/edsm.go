@@ -0,0 +1,238 @@
+package importer
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// edsmSystem is a system in EDSM's systemsWithCoordinates or systemsPopulated dumps; the
+// former only has the name and co-ordinates
+type edsmSystem struct {
+	Id     int64  `json:"id"`
+	Id64   int64  `json:"id64"`
+	Name   string `json:"name"`
+	Coords struct {
+		X json.Number `json:"x"`
+		Y json.Number `json:"y"`
+		Z json.Number `json:"z"`
+	} `json:"coords"`
+	Allegiance         string `json:"allegiance"`
+	Government         string `json:"government"`
+	State              string `json:"state"`
+	Economy            string `json:"economy"`
+	Security           string `json:"security"`
+	Population         int64  `json:"population"`
+	ControllingFaction *struct {
+		Name string `json:"name"`
+	} `json:"controllingFaction"`
+	Date string `json:"date"`
+}
+
+// edsmStation is a station in EDSM's stations dump.  EDSM's dumps have no market, outfitting
+// or shipyard listings, only whether they exist
+type edsmStation struct {
+	Id                 int64    `json:"id"`
+	MarketId           int64    `json:"marketId"`
+	SystemId           int64    `json:"systemId"`
+	Name               string   `json:"name"`
+	Type               string   `json:"type"`
+	DistanceToArrival  *float64 `json:"distanceToArrival"`
+	Allegiance         string   `json:"allegiance"`
+	Government         string   `json:"government"`
+	Economy            string   `json:"economy"`
+	HaveMarket         bool     `json:"haveMarket"`
+	HaveShipyard       bool     `json:"haveShipyard"`
+	HaveOutfitting     bool     `json:"haveOutfitting"`
+	OtherServices      []string `json:"otherServices"`
+	ControllingFaction *struct {
+		Name string `json:"name"`
+	} `json:"controllingFaction"`
+	UpdateTime struct {
+		Information string `json:"information"`
+		Market      string `json:"market"`
+		Shipyard    string `json:"shipyard"`
+		Outfitting  string `json:"outfitting"`
+	} `json:"updateTime"`
+}
+
+// The station services that EDDB recorded as flags, other than the market, shipyard and
+// outfitting which EDSM records separately
+var edsmStationServices = map[string]string{
+	"Black Market":                 "has_blackmarket",
+	"Fleet Carrier Vendor":         "has_carrier_vendor",
+	"Fleet Carrier Administration": "has_carrier_administration",
+	"Interstellar Factors Contact": "has_interstellar_factors",
+	"Material Trader":              "has_material_trader",
+	"Refuel":                       "has_refuel",
+	"Repair":                       "has_repair",
+	"Restock":                      "has_rearm",
+	"Technology Broker":            "has_technology_broker",
+	"Universal Cartographics":      "has_universal_cartographics",
+}
+
+// EDSM's IDs are used as our own.  They are not EDDB's, so a database is only ever built from
+// one source, and a rebuild carries everything else over by name and co-ordinates
+func (im *Import) importEDSM() error {
+	err := im.readDump("systemsWithCoordinates.json.gz", im.importEDSMSystem)
+	if err != nil {
+		return err
+	}
+	// Populated systems are updated in place, which needs the index
+	_, err = im.db.Exec("CREATE INDEX IF NOT EXISTS systems_idx1 ON systems(id)")
+	if err != nil {
+		return err
+	}
+	err = im.readDump("systemsPopulated.json.gz", im.importEDSMPopulatedSystem)
+	if err != nil {
+		return err
+	}
+	err = im.readDump("bodies.json.gz", im.importEDSMBody)
+	if err != nil {
+		return err
+	}
+	return im.readDump("stations.json.gz", im.importEDSMStation)
+}
+
+func (im *Import) importEDSMSystem(d *json.Decoder) error {
+	var edsm edsmSystem
+	err := d.Decode(&edsm)
+	if err != nil {
+		return err
+	}
+	err = checkId(edsm.Id)
+	if err != nil {
+		return err
+	}
+
+	data, updatedAt, err := edsmSystemData(&edsm)
+	if err != nil {
+		return err
+	}
+	return im.storeSystem(edsm.Id, string(edsm.Coords.X), string(edsm.Coords.Y), string(edsm.Coords.Z), edsm.Name, data, updatedAt)
+}
+
+// importEDSMPopulatedSystem fills in the details of a system that we have from
+// systemsWithCoordinates, adding it if for some reason we don't.  An incremental import goes
+// through storeSystem, so that it keeps what the listener has recorded
+func (im *Import) importEDSMPopulatedSystem(d *json.Decoder) error {
+	var edsm edsmSystem
+	err := d.Decode(&edsm)
+	if err != nil {
+		return err
+	}
+	err = checkId(edsm.Id)
+	if err != nil {
+		return err
+	}
+
+	data, updatedAt, err := edsmSystemData(&edsm)
+	if err != nil {
+		return err
+	}
+	if !im.Incremental {
+		result, err := im.db.Exec("UPDATE systems SET data = ? WHERE id = ?", data, edsm.Id)
+		if err != nil {
+			return err
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			return nil
+		}
+	}
+	return im.storeSystem(edsm.Id, string(edsm.Coords.X), string(edsm.Coords.Y), string(edsm.Coords.Z), edsm.Name, data, updatedAt)
+}
+
+// edsmSystemData is a system in the shape that the EDDB import produces
+func edsmSystemData(edsm *edsmSystem) (string, int64, error) {
+	system := make(map[string]interface{})
+	system["id"] = edsm.Id
+	system["ed_system_address"] = edsm.Id64
+	system["name"] = edsm.Name
+	system["x"] = edsm.Coords.X
+	system["y"] = edsm.Coords.Y
+	system["z"] = edsm.Coords.Z
+	system["is_populated"] = edsm.Population > 0
+	if edsm.Population > 0 {
+		system["population"] = edsm.Population
+	}
+	setString(system, "government", edsm.Government)
+	setString(system, "allegiance", edsm.Allegiance)
+	setString(system, "state", edsm.State)
+	setString(system, "security", edsm.Security)
+	setString(system, "primary_economy", edsm.Economy)
+	if edsm.ControllingFaction != nil {
+		setString(system, "faction", edsm.ControllingFaction.Name)
+	}
+	updatedAt := setTime(system, "updated_at", edsm.Date)
+
+	data, err := json.Marshal(system)
+	return string(data), updatedAt, err
+}
+
+func (im *Import) importEDSMBody(d *json.Decoder) error {
+	var edsm dumpBody
+	err := d.Decode(&edsm)
+	if err != nil {
+		return err
+	}
+	err = checkId(edsm.Id)
+	if err != nil {
+		return err
+	}
+
+	data, updatedAt, err := bodyData(edsm.Id, edsm.SystemId, &edsm)
+	if err != nil {
+		return err
+	}
+	return im.storeBody(edsm.Id, edsm.SystemId, edsm.Name, data, updatedAt)
+}
+
+// importEDSMStation imports a station in the shape that the EDDB import produces
+func (im *Import) importEDSMStation(d *json.Decoder) error {
+	var edsm edsmStation
+	err := d.Decode(&edsm)
+	if err != nil {
+		return err
+	}
+	err = checkId(edsm.Id)
+	if err != nil {
+		return err
+	}
+
+	station := make(map[string]interface{})
+	station["id"] = edsm.Id
+	station["system_id"] = edsm.SystemId
+	if edsm.MarketId != 0 {
+		station["ed_market_id"] = edsm.MarketId
+	}
+	station["name"] = edsm.Name
+	setString(station, "type", edsm.Type)
+	station["is_planetary"] = strings.Contains(edsm.Type, "Planetary") || strings.Contains(edsm.Type, "Settlement")
+	setFloat(station, "distance_to_star", edsm.DistanceToArrival)
+	setString(station, "allegiance", edsm.Allegiance)
+	setString(station, "government", edsm.Government)
+	if edsm.ControllingFaction != nil {
+		setString(station, "controlling_faction", edsm.ControllingFaction.Name)
+	}
+	setString(station, "primary_economy", edsm.Economy)
+	station["has_market"] = edsm.HaveMarket
+	station["has_shipyard"] = edsm.HaveShipyard
+	station["has_outfitting"] = edsm.HaveOutfitting
+	for _, key := range edsmStationServices {
+		station[key] = false
+	}
+	for _, service := range edsm.OtherServices {
+		if key, ok := edsmStationServices[service]; ok {
+			station[key] = true
+		}
+	}
+	updatedAt := setTime(station, "updated_at", edsm.UpdateTime.Information)
+	setTime(station, "market_updated_at", edsm.UpdateTime.Market)
+	setTime(station, "shipyard_updated_at", edsm.UpdateTime.Shipyard)
+	setTime(station, "outfitting_updated_at", edsm.UpdateTime.Outfitting)
+
+	data, err := json.Marshal(station)
+	if err != nil {
+		return err
+	}
+	return im.storeStation(edsm.Id, edsm.SystemId, edsm.Name, string(data), updatedAt)
+}
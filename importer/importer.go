@@ -0,0 +1,393 @@
+package importer
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"../logging"
+)
+
+// Source is where the systems, bodies and stations come from
+type Source string
+
+const (
+	Spansh Source = "spansh"
+	EDSM   Source = "edsm"
+	// EDDB has shut down, but its files may still be to hand
+	EDDB Source = "eddb"
+)
+
+// Files lists the files that a source provides, which are downloaded and imported together
+func (s Source) Files() []string {
+	switch s {
+	case Spansh:
+		return []string{"galaxy.json.gz"}
+	case EDSM:
+		return []string{"systemsWithCoordinates.json.gz", "systemsPopulated.json.gz", "bodies.json.gz", "stations.json.gz"}
+	case EDDB:
+		return []string{"systems.csv", "stations.jsonl", "bodies.jsonl", "commodities.json", "listings.csv", "factions.csv"}
+	}
+	return nil
+}
+
+// URL is where a source's files are downloaded from, unless configured otherwise
+func (s Source) URL() string {
+	switch s {
+	case Spansh:
+		return "https://downloads.spansh.co.uk/"
+	case EDSM:
+		return "https://www.edsm.net/dump/"
+	case EDDB:
+		return "https://eddb.io/archive/v5/"
+	}
+	return ""
+}
+
+// Systems, bodies and stations that the listener discovers are given negative IDs, from here
+// downwards, so imported IDs must be positive
+const localIdBase = -1
+
+// How often an import reports its progress, in rows
+const progressInterval = 100000
+
+// Import reads a source's files in to the systems, bodies and stations tables
+type Import struct {
+	Source Source
+	Dir    string
+	// An incremental import updates a database built from the same source, rather than filling
+	// an empty one
+	Incremental bool
+
+	db      *sql.DB
+	started time.Time
+	counts  map[string]int
+	// What an incremental import did
+	inserted, updated, skipped, adopted int
+}
+
+// New prepares to import the files in dir in to db.  BEGIN and COMMIT are separate statements,
+// so db must have only the one connection
+func New(db *sql.DB, source Source, dir string) *Import {
+	return &Import{Source: source, Dir: dir, db: db, counts: make(map[string]int)}
+}
+
+// checkId refuses an ID that could clash with those given out by the listener
+func checkId(id int64) error {
+	if id <= 0 {
+		return fmt.Errorf("ID %d clashes with those given out by the listener, which are negative", id)
+	}
+	return nil
+}
+
+// Run imports all of the source's files
+func (im *Import) Run() error {
+	im.started = time.Now()
+	var err error
+	if im.Incremental {
+		err = im.checkSource()
+		if err != nil {
+			return err
+		}
+	} else {
+		// Nothing else uses a database while it is being built, so it needn't be written safely
+		_, err = im.db.Exec("PRAGMA synchronous = OFF")
+		if err != nil {
+			return err
+		}
+		_, err = im.db.Exec("PRAGMA journal_mode = OFF")
+		if err != nil {
+			return err
+		}
+	}
+	err = SetupTables(im.db)
+	if err != nil {
+		return err
+	}
+
+	switch im.Source {
+	case Spansh:
+		err = im.importSpansh()
+	case EDSM:
+		err = im.importEDSM()
+	case EDDB:
+		err = im.importEDDB()
+	default:
+		return fmt.Errorf("Unknown source %s", im.Source)
+	}
+	if err != nil {
+		return err
+	}
+
+	logging.Info("Building indices")
+	err = SetupIndices(im.db)
+	if err != nil {
+		return err
+	}
+
+	fields := logging.Fields{"source": im.Source, "seconds": int(time.Since(im.started).Seconds())}
+	for entity, count := range im.counts {
+		fields[entity] = count
+	}
+	if im.Incremental {
+		fields["inserted"] = im.inserted
+		fields["updated"] = im.updated
+		fields["skipped"] = im.skipped
+		fields["adopted"] = im.adopted
+	}
+	logging.Info("Imported", fields)
+	return nil
+}
+
+// checkSource refuses an incremental import in to a database that was built from another source
+func (im *Import) checkSource() error {
+	var source string
+	err := im.db.QueryRow("SELECT source FROM build_info").Scan(&source)
+	if err == nil && Source(source) != im.Source {
+		return fmt.Errorf("Database was built from %s data, not %s", source, im.Source)
+	}
+	return nil
+}
+
+// count notes that a row has been imported, reporting progress every so often
+func (im *Import) count(entity string) {
+	im.counts[entity]++
+	if im.counts[entity]%progressInterval == 0 {
+		logging.Info("Importing", logging.Fields{"entity": entity, "count": im.counts[entity], "seconds": int(time.Since(im.started).Seconds())})
+	}
+}
+
+func SetupTables(db *sql.DB) error {
+	for _, statement := range []string{
+		"CREATE TABLE IF NOT EXISTS systems(id INT NOT NULL, x DECIMAL(10, 5) NOT NULL, y DECIMAL(10, 5) NOT NULL, z DECIMAL(10, 5) NOT NULL, name TEXT COLLATE NOCASE NOT NULL, data TEXT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS bodies(id INT NOT NULL, system_id INT NOT NULL, name TEXT COLLATE NOCASE NOT NULL, data TEXT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS stations(id INT NOT NULL, system_id INT NOT NULL, name TEXT COLLATE NOCASE NOT NULL, data TEXT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS id_map(kind TEXT NOT NULL, local_id INT NOT NULL, upstream_id INT NOT NULL)",
+	} {
+		_, err := db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SetupIndices(db *sql.DB) error {
+	for _, statement := range []string{
+		"CREATE INDEX IF NOT EXISTS systems_idx1 ON systems(id)",
+		"CREATE INDEX IF NOT EXISTS systems_idx2 ON systems(name)",
+		"CREATE INDEX IF NOT EXISTS bodies_idx1 ON bodies(id)",
+		"CREATE INDEX IF NOT EXISTS bodies_idx2 ON bodies(system_id)",
+		"CREATE INDEX IF NOT EXISTS bodies_idx3 ON bodies(name)",
+		"CREATE INDEX IF NOT EXISTS stations_idx1 ON stations(id)",
+		"CREATE INDEX IF NOT EXISTS stations_idx2 ON stations(system_id)",
+		"CREATE INDEX IF NOT EXISTS stations_idx3 ON stations(name)",
+		"CREATE INDEX IF NOT EXISTS id_map_idx1 ON id_map(kind, local_id)",
+	} {
+		_, err := db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return SetupSearchIndex(db)
+}
+
+// SetupSearchIndex creates systems_rtree, which indexes systems by their co-ordinates for
+// searches around a point, filling it from the systems that we already have.  Triggers then
+// keep it up to date as systems are added, moved and removed, whether by an import or by the
+// listener
+func SetupSearchIndex(db *sql.DB) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'systems_rtree')").Scan(&exists)
+	if err != nil {
+		return err
+	}
+	var statements []string
+	if !exists {
+		statements = append(statements,
+			"CREATE VIRTUAL TABLE systems_rtree USING rtree(id, min_x, max_x, min_y, max_y, min_z, max_z)",
+			"INSERT OR REPLACE INTO systems_rtree SELECT id, CAST(x AS FLOAT), CAST(x AS FLOAT), CAST(y AS FLOAT), CAST(y AS FLOAT), CAST(z AS FLOAT), CAST(z AS FLOAT) FROM systems")
+	}
+	statements = append(statements,
+		"CREATE TRIGGER IF NOT EXISTS systems_rtree_insert AFTER INSERT ON systems BEGIN INSERT OR REPLACE INTO systems_rtree VALUES(new.id, CAST(new.x AS FLOAT), CAST(new.x AS FLOAT), CAST(new.y AS FLOAT), CAST(new.y AS FLOAT), CAST(new.z AS FLOAT), CAST(new.z AS FLOAT)); END",
+		"CREATE TRIGGER IF NOT EXISTS systems_rtree_update AFTER UPDATE OF id, x, y, z ON systems BEGIN DELETE FROM systems_rtree WHERE id = old.id; INSERT OR REPLACE INTO systems_rtree VALUES(new.id, CAST(new.x AS FLOAT), CAST(new.x AS FLOAT), CAST(new.y AS FLOAT), CAST(new.y AS FLOAT), CAST(new.z AS FLOAT), CAST(new.z AS FLOAT)); END",
+		"CREATE TRIGGER IF NOT EXISTS systems_rtree_delete AFTER DELETE ON systems BEGIN DELETE FROM systems_rtree WHERE id = old.id; END")
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An incremental import commits every so many rows, so that the listener can write in between
+const batchSize = 1000
+
+func (im *Import) begin() error {
+	_, err := im.db.Exec("BEGIN")
+	return err
+}
+
+func (im *Import) commit() error {
+	_, err := im.db.Exec("COMMIT")
+	return err
+}
+
+// commitBatch commits after every batchSize rows of an incremental import
+func (im *Import) commitBatch() error {
+	if !im.Incremental || (im.inserted+im.updated+im.skipped)%batchSize != 0 {
+		return nil
+	}
+	err := im.commit()
+	if err != nil {
+		return err
+	}
+	return im.begin()
+}
+
+// The listener records these in a system without changing updated_at, as they are not part of
+// the system's political state and don't come from upstream, so replacing a system from upstream
+// must keep them.  This selects them from the given system data as a JSON object
+func listenerSystemKeys(data string) string {
+	return "(SELECT json_group_object(key, CASE type WHEN 'true' THEN json('true') WHEN 'false' THEN json('false') ELSE value END) FROM json_each(" + data + ") WHERE key IN ('body_count', 'all_bodies_found', 'primary_star_class'))"
+}
+
+// storeSystem adds a system.  An incremental import instead replaces ours if the upstream copy
+// was updated more recently.  The listener sets updated_at when it changes a system, so its
+// changes are only replaced by ones that are newer still
+func (im *Import) storeSystem(id interface{}, x interface{}, y interface{}, z interface{}, name string, data string, updatedAt int64) error {
+	im.count("systems")
+	if !im.Incremental {
+		_, err := im.db.Exec("INSERT INTO systems(id, x, y, z, name, data) VALUES(?, ?, ?, ?, ?, ?)", id, x, y, z, name, data)
+		return err
+	}
+	return im.upsert("UPDATE systems SET x = ?, y = ?, z = ?, name = ?, data = json_patch(?, "+listenerSystemKeys("systems.data")+") WHERE id = ? AND COALESCE(CAST(json_extract(data, '$.updated_at') AS INT), 0) < ?", []interface{}{x, y, z, name, data, id, updatedAt},
+		func() (bool, error) {
+			return im.adopt("system", "systems", id, "name = ? AND CAST(x AS FLOAT) = CAST(? AS FLOAT) AND CAST(y AS FLOAT) = CAST(? AS FLOAT) AND CAST(z AS FLOAT) = CAST(? AS FLOAT)", name, x, y, z)
+		},
+		"INSERT INTO systems(id, x, y, z, name, data) SELECT ?, ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM systems WHERE id = ?)", []interface{}{id, x, y, z, name, data, id})
+}
+
+// storeBody adds a body, or in an incremental import replaces ours if the upstream copy is newer
+func (im *Import) storeBody(id interface{}, systemId interface{}, name string, data string, updatedAt int64) error {
+	im.count("bodies")
+	if !im.Incremental {
+		_, err := im.db.Exec("INSERT INTO bodies(id, system_id, name, data) VALUES(?, ?, ?, ?)", id, systemId, name, data)
+		return err
+	}
+	return im.upsert("UPDATE bodies SET system_id = ?, name = ?, data = ? WHERE id = ? AND COALESCE(CAST(json_extract(data, '$.updated_at') AS INT), 0) < ?", []interface{}{systemId, name, data, id, updatedAt},
+		func() (bool, error) {
+			return im.adopt("body", "bodies", id, "system_id = ? AND name = ?", systemId, name)
+		},
+		"INSERT INTO bodies(id, system_id, name, data) SELECT ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM bodies WHERE id = ?)", []interface{}{id, systemId, name, data, id})
+}
+
+// storeStation adds a station, or in an incremental import replaces ours if the upstream copy
+// is newer.  The listener updates the station, market and outfitting separately, each with its
+// own time, so the upstream copy must be newer than all of them
+func (im *Import) storeStation(id interface{}, systemId interface{}, name string, data string, updatedAt int64) error {
+	im.count("stations")
+	if !im.Incremental {
+		_, err := im.db.Exec("INSERT INTO stations(id, system_id, name, data) VALUES(?, ?, ?, ?)", id, systemId, name, data)
+		return err
+	}
+	return im.upsert("UPDATE stations SET system_id = ?, name = ?, data = ? WHERE id = ? AND max(COALESCE(CAST(json_extract(data, '$.updated_at') AS INT), 0), COALESCE(CAST(json_extract(data, '$.market_updated_at') AS INT), 0), COALESCE(CAST(json_extract(data, '$.outfitting_updated_at') AS INT), 0)) < ?", []interface{}{systemId, name, data, id, updatedAt},
+		func() (bool, error) {
+			return im.adopt("station", "stations", id, "system_id = ? AND name = ?", systemId, name)
+		},
+		"INSERT INTO stations(id, system_id, name, data) SELECT ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM stations WHERE id = ?)", []interface{}{id, systemId, name, data, id})
+}
+
+// upsert updates a row if the update's conditions hold.  Otherwise, if the row isn't there, it
+// adopts a row that the listener discovered as the same thing, and updates that if the update's
+// conditions hold, or failing that inserts it
+func (im *Import) upsert(update string, updateArgs []interface{}, adopt func() (bool, error), insert string, insertArgs []interface{}) error {
+	result, err := im.db.Exec(update, updateArgs...)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		im.updated++
+		return im.commitBatch()
+	}
+	adopted, err := adopt()
+	if err != nil {
+		return err
+	}
+	if adopted {
+		im.adopted++
+		result, err = im.db.Exec(update, updateArgs...)
+		if err != nil {
+			return err
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			im.updated++
+		} else {
+			im.skipped++
+		}
+	} else {
+		result, err = im.db.Exec(insert, insertArgs...)
+		if err != nil {
+			return err
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			im.inserted++
+		} else {
+			im.skipped++
+		}
+	}
+	return im.commitBatch()
+}
+
+// adopt gives the upstream ID to a row that the listener discovered and that matches the
+// upstream one, so that an incremental import doesn't add the same thing twice.  The mapping is
+// recorded in id_map, as a rebuild does.  A system's bodies, stations and codex entries move
+// with it.  Nothing is adopted if we already have the upstream row
+func (im *Import) adopt(kind string, table string, id interface{}, match string, matchArgs ...interface{}) (bool, error) {
+	var exists bool
+	err := im.db.QueryRow("SELECT EXISTS (SELECT 1 FROM "+table+" WHERE id = ?)", id).Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+	var localId int64
+	err = im.db.QueryRow("SELECT id FROM "+table+" WHERE id <= ? AND "+match, append([]interface{}{localIdBase}, matchArgs...)...).Scan(&localId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = im.db.Exec("UPDATE "+table+" SET id = ?, data = json_set(data, '$.id', CAST(? AS INTEGER)) WHERE id = ?", id, id, localId)
+	if err != nil {
+		return false, err
+	}
+	if kind == "system" {
+		for _, child := range []string{"bodies", "stations", "codex"} {
+			exists, err = im.tableExists(child)
+			if err != nil {
+				return false, err
+			}
+			if !exists {
+				continue
+			}
+			_, err = im.db.Exec("UPDATE "+child+" SET system_id = ?, data = json_set(data, '$.system_id', CAST(? AS INTEGER)) WHERE system_id = ?", id, id, localId)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	_, err = im.db.Exec("INSERT INTO id_map(kind, local_id, upstream_id) VALUES(?, ?, ?)", kind, localId, id)
+	if err != nil {
+		return false, err
+	}
+	logging.Info("Adopted", logging.Fields{"kind": kind, "local_id": localId, "id": id})
+	return true, nil
+}
+
+func (im *Import) tableExists(table string) (bool, error) {
+	var exists bool
+	err := im.db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,292 @@
+package importer
+
+import (
+	"encoding/json"
+
+	"../dataDefs"
+	"../logging"
+)
+
+// spanshSystem is a system in a Spansh galaxy dump, with the bodies and stations in it
+type spanshSystem struct {
+	Id64   int64  `json:"id64"`
+	Name   string `json:"name"`
+	Coords struct {
+		X json.Number `json:"x"`
+		Y json.Number `json:"y"`
+		Z json.Number `json:"z"`
+	} `json:"coords"`
+	Allegiance         string          `json:"allegiance"`
+	Government         string          `json:"government"`
+	PrimaryEconomy     string          `json:"primaryEconomy"`
+	Security           string          `json:"security"`
+	Population         int64           `json:"population"`
+	ControllingFaction *spanshFaction  `json:"controllingFaction"`
+	Factions           []spanshFaction `json:"factions"`
+	Powers             []string        `json:"powers"`
+	PowerState         string          `json:"powerState"`
+	Date               string          `json:"date"`
+	Bodies             []dumpBody      `json:"bodies"`
+	Stations           []spanshStation `json:"stations"`
+}
+
+type spanshFaction struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+type spanshStation struct {
+	Id                      int64    `json:"id"`
+	Name                    string   `json:"name"`
+	Type                    string   `json:"type"`
+	DistanceToArrival       *float64 `json:"distanceToArrival"`
+	Allegiance              string   `json:"allegiance"`
+	Government              string   `json:"government"`
+	ControllingFaction      string   `json:"controllingFaction"`
+	ControllingFactionState string   `json:"controllingFactionState"`
+	PrimaryEconomy          string   `json:"primaryEconomy"`
+	Services                []string `json:"services"`
+	LandingPads             *struct {
+		Large  int `json:"large"`
+		Medium int `json:"medium"`
+		Small  int `json:"small"`
+	} `json:"landingPads"`
+	Market *struct {
+		Commodities []struct {
+			Name      string `json:"name"`
+			Supply    int64  `json:"supply"`
+			BuyPrice  int64  `json:"buyPrice"`
+			Demand    int64  `json:"demand"`
+			SellPrice int64  `json:"sellPrice"`
+		} `json:"commodities"`
+		UpdateTime string `json:"updateTime"`
+	} `json:"market"`
+	Outfitting *struct {
+		Modules []struct {
+			Symbol string `json:"symbol"`
+		} `json:"modules"`
+		UpdateTime string `json:"updateTime"`
+	} `json:"outfitting"`
+	Shipyard *struct {
+		Ships []struct {
+			Name string `json:"name"`
+		} `json:"ships"`
+		UpdateTime string `json:"updateTime"`
+	} `json:"shipyard"`
+	UpdateTime string `json:"updateTime"`
+}
+
+// The station services that EDDB recorded as flags
+var spanshStationServices = map[string]string{
+	"Black Market":                 "has_blackmarket",
+	"Dock":                         "has_docking",
+	"Fleet Carrier Vendor":         "has_carrier_vendor",
+	"Fleet Carrier Administration": "has_carrier_administration",
+	"Interstellar Factors Contact": "has_interstellar_factors",
+	"Market":                       "has_market",
+	"Material Trader":              "has_material_trader",
+	"Outfitting":                   "has_outfitting",
+	"Refuel":                       "has_refuel",
+	"Repair":                       "has_repair",
+	"Restock":                      "has_rearm",
+	"Shipyard":                     "has_shipyard",
+	"Technology Broker":            "has_technology_broker",
+	"Universal Cartographics":      "has_universal_cartographics",
+}
+
+// Spansh identifies systems by their 64-bit system address and stations by their market ID,
+// both of which the game assigns and never changes, so we use them as our IDs and they stay the
+// same from one import to the next
+func (im *Import) importSpansh() error {
+	return im.readDump("galaxy.json.gz", func(d *json.Decoder) error {
+		var system spanshSystem
+		err := d.Decode(&system)
+		if err != nil {
+			return err
+		}
+		return im.importSpanshSystem(&system)
+	})
+}
+
+// The game's ID for a body is its system's address with the body's ID within the system in the
+// top bits, from here up
+const bodyIdShift = 55
+
+// spanshBodyId gives a body the game's ID for it.  Our IDs must be positive, so the top bit is
+// not available and bodies numbered from 256 up within their system can't be given one
+func spanshBodyId(systemId int64, body *dumpBody) (int64, bool) {
+	if body.BodyId == nil || *body.BodyId < 0 || *body.BodyId >= 1<<(63-bodyIdShift) || systemId>>bodyIdShift != 0 {
+		return 0, false
+	}
+	return *body.BodyId<<bodyIdShift | systemId, true
+}
+
+// importSpanshSystem imports a system along with its bodies and stations
+func (im *Import) importSpanshSystem(spansh *spanshSystem) error {
+	systemId := spansh.Id64
+	err := checkId(systemId)
+	if err != nil {
+		return err
+	}
+
+	system := make(map[string]interface{})
+	system["id"] = systemId
+	system["ed_system_address"] = spansh.Id64
+	system["name"] = spansh.Name
+	system["x"] = spansh.Coords.X
+	system["y"] = spansh.Coords.Y
+	system["z"] = spansh.Coords.Z
+	system["is_populated"] = spansh.Population > 0
+	if spansh.Population > 0 {
+		system["population"] = spansh.Population
+	}
+	setString(system, "government", spansh.Government)
+	setString(system, "allegiance", spansh.Allegiance)
+	setString(system, "security", spansh.Security)
+	setString(system, "primary_economy", spansh.PrimaryEconomy)
+	if spansh.ControllingFaction != nil {
+		setString(system, "faction", spansh.ControllingFaction.Name)
+		// The system's state is that of its controlling faction
+		for _, faction := range spansh.Factions {
+			if faction.Name == spansh.ControllingFaction.Name {
+				setString(system, "state", faction.State)
+			}
+		}
+	}
+	if len(spansh.Powers) == 1 {
+		system["power"] = spansh.Powers[0]
+	}
+	setString(system, "power_state", spansh.PowerState)
+	updatedAt := setTime(system, "updated_at", spansh.Date)
+
+	data, err := json.Marshal(system)
+	if err != nil {
+		return err
+	}
+	err = im.storeSystem(systemId, string(spansh.Coords.X), string(spansh.Coords.Y), string(spansh.Coords.Z), spansh.Name, string(data), updatedAt)
+	if err != nil {
+		return err
+	}
+
+	for i := range spansh.Bodies {
+		body := &spansh.Bodies[i]
+		bodyId, ok := spanshBodyId(systemId, body)
+		if ok {
+			data, updatedAt, err := bodyData(bodyId, systemId, body)
+			if err != nil {
+				return err
+			}
+			err = im.storeBody(bodyId, systemId, body.Name, data, updatedAt)
+			if err != nil {
+				return err
+			}
+		} else {
+			logging.Warn("Body without a usable ID", logging.Fields{"system": spansh.Name, "body": body.Name})
+		}
+		// Stations on a body are planetary
+		for j := range body.Stations {
+			err = im.importSpanshStation(systemId, &body.Stations[j], true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i := range spansh.Stations {
+		err = im.importSpanshStation(systemId, &spansh.Stations[i], false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *Import) importSpanshStation(systemId int64, spansh *spanshStation, planetary bool) error {
+	// The market ID identifies the station
+	stationId := spansh.Id
+	if stationId == 0 {
+		logging.Warn("Station without a market ID", logging.Fields{"station": spansh.Name})
+		return nil
+	}
+	err := checkId(stationId)
+	if err != nil {
+		return err
+	}
+
+	station := make(map[string]interface{})
+	station["id"] = stationId
+	station["system_id"] = systemId
+	station["ed_market_id"] = spansh.Id
+	station["name"] = spansh.Name
+	setString(station, "type", spansh.Type)
+	station["is_planetary"] = planetary
+	setFloat(station, "distance_to_star", spansh.DistanceToArrival)
+	setString(station, "allegiance", spansh.Allegiance)
+	setString(station, "government", spansh.Government)
+	setString(station, "controlling_faction", spansh.ControllingFaction)
+	setString(station, "state", spansh.ControllingFactionState)
+	setString(station, "primary_economy", spansh.PrimaryEconomy)
+	if spansh.LandingPads != nil {
+		if spansh.LandingPads.Large > 0 {
+			station["max_landing_pad_size"] = "L"
+		} else if spansh.LandingPads.Medium > 0 {
+			station["max_landing_pad_size"] = "M"
+		} else if spansh.LandingPads.Small > 0 {
+			station["max_landing_pad_size"] = "S"
+		}
+	}
+	for _, key := range spanshStationServices {
+		station[key] = false
+	}
+	for _, service := range spansh.Services {
+		if key, ok := spanshStationServices[service]; ok {
+			station[key] = true
+		}
+	}
+	updatedAt := setTime(station, "updated_at", spansh.UpdateTime)
+
+	if spansh.Market != nil {
+		commodities := make([]map[string]interface{}, 0, len(spansh.Market.Commodities))
+		for _, spanshCommodity := range spansh.Market.Commodities {
+			commodity := make(map[string]interface{})
+			commodity["name"] = spanshCommodity.Name
+			id, exists := dataDefs.CommodityIDs[spanshCommodity.Name]
+			if !exists {
+				id = -1
+			}
+			commodity["id"] = id
+			if spanshCommodity.Supply > 0 {
+				commodity["supply"] = spanshCommodity.Supply
+				commodity["buy_price"] = spanshCommodity.BuyPrice
+			}
+			if spanshCommodity.Demand > 0 {
+				commodity["demand"] = spanshCommodity.Demand
+				commodity["sell_price"] = spanshCommodity.SellPrice
+			}
+			commodities = append(commodities, commodity)
+		}
+		station["commodities"] = commodities
+		setTime(station, "market_updated_at", spansh.Market.UpdateTime)
+	}
+	if spansh.Outfitting != nil {
+		modules := make([]string, len(spansh.Outfitting.Modules))
+		for i, module := range spansh.Outfitting.Modules {
+			modules[i] = module.Symbol
+		}
+		station["selling_modules"] = modules
+		setTime(station, "outfitting_updated_at", spansh.Outfitting.UpdateTime)
+	}
+	if spansh.Shipyard != nil {
+		ships := make([]string, len(spansh.Shipyard.Ships))
+		for i, ship := range spansh.Shipyard.Ships {
+			ships[i] = ship.Name
+		}
+		station["selling_ships"] = ships
+		setTime(station, "shipyard_updated_at", spansh.Shipyard.UpdateTime)
+	}
+
+	data, err := json.Marshal(station)
+	if err != nil {
+		return err
+	}
+	return im.storeStation(stationId, systemId, spansh.Name, string(data), updatedAt)
+}
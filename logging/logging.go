@@ -0,0 +1,156 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel turns a level name such as "warn" in to a Level
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, errors.New("Unknown log level " + name)
+}
+
+// Fields add structure to a log entry, e.g. the system, station, schema or software concerned
+type Fields map[string]interface{}
+
+var mutex sync.Mutex
+var output io.Writer = os.Stderr
+var minLevel = InfoLevel
+
+// stdWriter passes on lines written with the standard log package, such as those from the
+// packages that we use
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	write(InfoLevel, strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+// The level is set from the configuration once it is loaded
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+}
+
+func SetLevel(level Level) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	minLevel = level
+}
+
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	output = w
+}
+
+func Enabled(level Level) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return level >= minLevel
+}
+
+func Debug(msg string, fields ...Fields) {
+	write(DebugLevel, msg, fields)
+}
+
+func Info(msg string, fields ...Fields) {
+	write(InfoLevel, msg, fields)
+}
+
+func Warn(msg string, fields ...Fields) {
+	write(WarnLevel, msg, fields)
+}
+
+func Error(msg string, fields ...Fields) {
+	write(ErrorLevel, msg, fields)
+}
+
+// Fatal logs an error and exits
+func Fatal(msg string, fields ...Fields) {
+	write(ErrorLevel, msg, fields)
+	os.Exit(1)
+}
+
+// write outputs an entry as a single line of JSON, starting with the time, level and message.
+// Errors are written as their message, as they would otherwise appear as empty objects
+func write(level Level, msg string, fields []Fields) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if level < minLevel {
+		return
+	}
+
+	merged := make(map[string]interface{})
+	for _, f := range fields {
+		for key, value := range f {
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			merged[key] = value
+		}
+	}
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		if key != "time" && key != "level" && key != "msg" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var line bytes.Buffer
+	line.WriteString("{\"time\":")
+	writeValue(&line, time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(",\"level\":")
+	writeValue(&line, level.String())
+	line.WriteString(",\"msg\":")
+	writeValue(&line, msg)
+	for _, key := range keys {
+		line.WriteString(",")
+		writeValue(&line, key)
+		line.WriteString(":")
+		writeValue(&line, merged[key])
+	}
+	line.WriteString("}\n")
+	output.Write(line.Bytes())
+}
+
+func writeValue(line *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(encoded)
+}